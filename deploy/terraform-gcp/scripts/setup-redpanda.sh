@@ -18,6 +18,7 @@ setup_redpanda() {
     rpk config set organization singlestore
     rpk config set redpanda.default_topic_partitions ${partitions_per_topic}
     rpk config set redpanda.enable_idempotence true
+    rpk config set redpanda.enable_transactions true
     rpk config set redpanda.enable_auto_rebalance_on_node_add true
 
     if [[ ${node_index} -eq 0 ]]; then
@@ -32,6 +33,10 @@ setup_redpanda() {
     if [[ ${node_index} -ne 0 ]]; then
         rpk topic create --replicas 1 --partitions ${partitions_per_topic} packages
         rpk topic create --replicas 1 --partitions ${partitions_per_topic} transitions
+        rpk topic create --replicas 1 --partitions ${partitions_per_topic} shipments
+        rpk topic create --replicas 1 --partitions ${partitions_per_topic} package_routes
+        rpk topic create --replicas 1 --partitions ${partitions_per_topic} handoffs
+        rpk topic create --replicas 1 --partitions 1 -c cleanup.policy=compact checkpoints
     fi
 }
 
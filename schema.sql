@@ -30,6 +30,9 @@ CREATE TABLE packages (
     -- express packages are delivered using the fastest method at each point
     method ENUM ('standard', 'express') NOT NULL,
 
+    -- parent_packageid is set on returns and refers to the package being returned
+    parent_packageid CHAR(36),
+
     -- marks when the row was created
     created DATETIME NOT NULL DEFAULT NOW(),
 
@@ -84,6 +87,10 @@ CREATE TABLE package_transitions (
     -- currently only used for departure scans
     next_locationid BIGINT,
 
+    -- the mode of transportation towards next_locationid
+    -- only set on departure scans
+    mode ENUM ('land', 'rail', 'air', 'sea'),
+
     -- when did this transition happen
     recorded DATETIME NOT NULL,
 
@@ -96,7 +103,19 @@ CREATE TABLE package_transitions (
         -- departure scan means the package is enroute to another location
         'departure_scan',
         -- delivered means the package was successfully delivered
-        'delivered'
+        'delivered',
+        -- exception delay means the package is held at it's current location
+        'exception_delay',
+        -- misrouted means the package arrived at the wrong location and will be rerouted
+        'misrouted',
+        -- damaged means the package was damaged and is held for repackaging
+        'damaged',
+        -- delivery attempt failed means the package will be redelivered the next day
+        'delivery_attempt_failed',
+        -- returned to sender means the package will not be delivered and is routed back to it's origin
+        'returned_to_sender',
+        -- lost means the package never arrived at it's next location
+        'lost'
     ) NOT NULL,
 
     KEY (recorded) USING CLUSTERED COLUMNSTORE,
@@ -131,7 +150,8 @@ FORMAT AVRO (
     @delivery_estimate <- DeliveryEstimate,
     origin_locationid <- OriginLocationID,
     destination_locationid <- DestinationLocationID,
-    method <- Method
+    method <- Method,
+    parent_packageid <- ParentPackageID
 )
 SCHEMA '{
     "type": "record",
@@ -145,7 +165,8 @@ SCHEMA '{
         { "name": "DestinationLocationID", "type": "long" },
         { "name": "Method", "type": { "name": "Method", "type": "enum", "symbols": [
             "standard", "express"
-        ] } }
+        ] } },
+        { "name": "ParentPackageID", "type": ["null", { "type": "string", "logicalType": "uuid" }], "default": null }
     ]
 }'
 SET
@@ -162,11 +183,12 @@ CREATE OR REPLACE PROCEDURE process_transitions(batch QUERY(
     locationid BIGINT NOT NULL,
     next_locationid BIGINT,
     recorded DATETIME NOT NULL,
-    kind TEXT NOT NULL
+    kind TEXT NOT NULL,
+    mode TEXT
 ))
 AS
 BEGIN
-    REPLACE INTO package_transitions (packageid, seq, locationid, next_locationid, recorded, kind)
+    REPLACE INTO package_transitions (packageid, seq, locationid, next_locationid, recorded, kind, mode)
     SELECT * FROM batch;
 
     INSERT INTO package_states (packageid, seq, locationid, next_locationid, recorded, kind)
@@ -178,13 +200,15 @@ BEGIN
         recorded,
         statekind AS kind
     FROM (
+        -- packages waiting at their destination for another delivery attempt
+        -- stay in transit to it, every other kind leaves the package at rest
         SELECT *, CASE
-            WHEN kind = "arrival_scan" THEN "at_rest"
-            WHEN kind = "departure_scan" THEN "in_transit"
+            WHEN kind IN ("departure_scan", "delivery_attempt_failed") THEN "in_transit"
+            ELSE "at_rest"
         END AS statekind
         FROM batch
     ) batch
-    WHERE batch.kind != "delivered"
+    WHERE batch.kind NOT IN ("delivered", "lost")
     ON DUPLICATE KEY UPDATE
         seq = IF(VALUES(seq) > package_states.seq, VALUES(seq), package_states.seq),
         locationid = IF(VALUES(seq) > package_states.seq, VALUES(locationid), package_states.locationid),
@@ -196,7 +220,7 @@ BEGIN
     FROM package_states JOIN batch
     WHERE
         package_states.packageid = batch.packageid
-        AND batch.kind = "delivered";
+        AND batch.kind IN ("delivered", "lost");
 
 END //
 
@@ -211,7 +235,8 @@ FORMAT AVRO (
     locationid <- LocationID,
     next_locationid <- NextLocationID,
     @recorded <- Recorded,
-    kind <- Kind
+    kind <- Kind,
+    mode <- Mode
 )
 SCHEMA '{
     "type": "record",
@@ -223,11 +248,139 @@ SCHEMA '{
         { "name": "NextLocationID", "type": ["null", "long"] },
         { "name": "Recorded", "type": { "type": "long", "logicalType": "timestamp-millis" } },
         { "name": "Kind", "type": { "name": "Kind", "type": "enum", "symbols": [
-            "arrival_scan", "departure_scan", "delivered"
-        ] } }
+            "arrival_scan", "departure_scan", "delivered",
+            "exception_delay", "misrouted", "damaged",
+            "delivery_attempt_failed", "returned_to_sender", "lost"
+        ] } },
+        { "name": "Mode", "type": ["null", { "name": "Mode", "type": "enum", "symbols": [
+            "land", "rail", "air", "sea"
+        ] }], "default": null }
     ]
 }'
 SET
     recorded = DATE_ADD(FROM_UNIXTIME(0), INTERVAL (@recorded / 1000) SECOND);
 
 START PIPELINE transitions;
+
+-- the shipments table stores one row per vehicle departure
+CREATE TABLE shipments (
+    shipmentid CHAR(36) NOT NULL,
+
+    -- identifies the vehicle on the lane; multiple vehicles leave at the same
+    -- time if the first is full
+    vehicleid TEXT NOT NULL,
+
+    mode ENUM ('land', 'rail', 'air', 'sea') NOT NULL,
+
+    origin_locationid BIGINT NOT NULL,
+    destination_locationid BIGINT NOT NULL,
+
+    departure DATETIME NOT NULL,
+    arrival DATETIME NOT NULL,
+
+    -- json array of the packageids on board
+    packageids JSON NOT NULL,
+
+    KEY (departure) USING CLUSTERED COLUMNSTORE,
+    SHARD (shipmentid)
+);
+
+CREATE PIPELINE shipments
+AS LOAD DATA KAFKA 'rp-node-0/shipments'
+SKIP DUPLICATE KEY ERRORS
+INTO TABLE shipments
+FORMAT AVRO (
+    shipmentid <- ShipmentID,
+    vehicleid <- VehicleID,
+    mode <- Mode,
+    origin_locationid <- OriginLocationID,
+    destination_locationid <- DestinationLocationID,
+    @departure <- Departure,
+    @arrival <- Arrival,
+    packageids <- PackageIDs
+)
+SCHEMA '{
+    "type": "record",
+    "name": "Shipment",
+    "fields": [
+        { "name": "ShipmentID", "type": { "type": "string", "logicalType": "uuid" } },
+        { "name": "VehicleID", "type": "string" },
+        { "name": "Mode", "type": { "name": "Mode", "type": "enum", "symbols": [
+            "land", "rail", "air", "sea"
+        ] } },
+        { "name": "OriginLocationID", "type": "long" },
+        { "name": "DestinationLocationID", "type": "long" },
+        { "name": "Departure", "type": { "type": "long", "logicalType": "timestamp-millis" } },
+        { "name": "Arrival", "type": { "type": "long", "logicalType": "timestamp-millis" } },
+        { "name": "PackageIDs", "type": { "type": "array", "items": { "type": "string", "logicalType": "uuid" } } }
+    ]
+}'
+SET
+    departure = DATE_ADD(FROM_UNIXTIME(0), INTERVAL (@departure / 1000) SECOND),
+    arrival = DATE_ADD(FROM_UNIXTIME(0), INTERVAL (@arrival / 1000) SECOND);
+
+START PIPELINE shipments;
+
+-- the package_routes table stores the route planned for each package when it is received
+CREATE TABLE package_routes (
+    packageid CHAR(36) NOT NULL,
+
+    -- the position of this location on the route, starting at 0 for the origin
+    hop INT NOT NULL,
+
+    locationid BIGINT NOT NULL,
+
+    planned_arrival DATETIME NOT NULL,
+
+    -- null for the final hop
+    planned_departure DATETIME,
+
+    KEY (planned_arrival) USING CLUSTERED COLUMNSTORE,
+    KEY (packageid) USING HASH,
+    SHARD (packageid)
+);
+
+CREATE PIPELINE package_routes
+AS LOAD DATA KAFKA 'rp-node-0/package_routes'
+SKIP DUPLICATE KEY ERRORS
+INTO TABLE package_routes
+FORMAT AVRO (
+    packageid <- PackageID,
+    hop <- Hop,
+    locationid <- LocationID,
+    @planned_arrival <- PlannedArrival,
+    @planned_departure <- PlannedDeparture
+)
+SCHEMA '{
+    "type": "record",
+    "name": "RouteHop",
+    "fields": [
+        { "name": "PackageID", "type": { "type": "string", "logicalType": "uuid" } },
+        { "name": "Hop", "type": "int" },
+        { "name": "LocationID", "type": "long" },
+        { "name": "PlannedArrival", "type": { "type": "long", "logicalType": "timestamp-millis" } },
+        { "name": "PlannedDeparture", "type": ["null", { "type": "long", "logicalType": "timestamp-millis" }], "default": null }
+    ]
+}'
+SET
+    planned_arrival = DATE_ADD(FROM_UNIXTIME(0), INTERVAL (@planned_arrival / 1000) SECOND),
+    planned_departure = DATE_ADD(FROM_UNIXTIME(0), INTERVAL (@planned_departure / 1000) SECOND);
+
+START PIPELINE package_routes;
+
+-- compares the planned arrival at each hop with the first time the package
+-- actually arrived there; actual_arrival is null until the package arrives
+-- and stays null if the package never reaches the hop
+CREATE VIEW package_route_arrivals AS
+SELECT
+    r.packageid,
+    r.hop,
+    r.locationid,
+    r.planned_arrival,
+    MIN(t.recorded) AS actual_arrival
+FROM package_routes r
+LEFT JOIN package_transitions t ON
+    t.packageid = r.packageid
+    AND t.locationid = r.locationid
+    AND t.kind IN ('arrival_scan', 'delivered')
+GROUP BY r.packageid, r.hop, r.locationid, r.planned_arrival;
@@ -0,0 +1,41 @@
+package simulator
+
+import (
+	"math"
+	"time"
+)
+
+// Arrivals tracks the package arrival process
+// packages arrive as a poisson process whose rate (packages per simulated hour)
+// is drawn from PackagesPerTick at the start of each hour
+type Arrivals struct {
+	// Next is the time of the next arrival, or of the next rate change if Arrival is false
+	Next    time.Time
+	Arrival bool
+
+	Rate      float64
+	RateUntil time.Time
+}
+
+// scheduleArrival schedules the first arrival after t
+func (s *State) scheduleArrival(t time.Time) {
+	a := &s.Arrivals
+	if !t.Before(a.RateUntil) {
+		a.Rate = math.Max(s.PackagesPerTick.Rand(), 0)
+		a.RateUntil = t.Truncate(time.Hour).Add(time.Hour)
+	}
+
+	if a.Rate > 0 {
+		// inter-arrival times are exponentially distributed
+		next := t.Add(hoursDuration(s.Rand.ExpFloat64() / a.Rate))
+		if next.Before(a.RateUntil) {
+			a.Next = next
+			a.Arrival = true
+			return
+		}
+	}
+
+	// the process is memoryless, so start over with a new rate when the hour ends
+	a.Next = a.RateUntil
+	a.Arrival = false
+}
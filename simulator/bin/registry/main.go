@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"simulator/registry"
+)
+
+func main() {
+	addr := ""
+	file := ""
+
+	flag.StringVar(&addr, "addr", ":8081", "address to serve the schema registry on")
+	flag.StringVar(&file, "file", "registry.json", "file the registered schemas are persisted to; empty keeps them in memory")
+
+	flag.Parse()
+
+	log.SetFlags(log.Ldate | log.Ltime)
+
+	r, err := registry.Open(file)
+	if err != nil {
+		log.Fatalf("unable to open registry: %+v", err)
+	}
+
+	log.Printf("serving schema registry on %s", addr)
+	err = http.ListenAndServe(addr, registry.NewServer(r))
+	if err != nil {
+		log.Fatalf("schema registry stopped: %+v", err)
+	}
+}
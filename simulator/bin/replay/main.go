@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"simulator"
+	"sort"
+	"strings"
+)
+
+// replayingSuffix marks dead letter files which are being replayed so
+// simulators still running start new files
+const replayingSuffix = ".replaying"
+
+// replay produces the records in the dead letter directory again and removes
+// each file once all of it's records have been produced
+func main() {
+	configPaths := simulator.FlagStringSlice{}
+	dir := ""
+
+	flag.Var(&configPaths, "config", "path to the config file; can be provided multiple times, files will be merged in the order provided")
+	flag.StringVar(&dir, "dir", "", "directory containing the dead letter files; defaults to topics.dead_letter_dir")
+
+	flag.Parse()
+
+	log.SetFlags(log.Ldate | log.Ltime)
+
+	config, err := simulator.ParseConfigFlags(configPaths)
+	if err != nil {
+		log.Fatalf("unable to load config files: %v; error: %+v", configPaths, err)
+	}
+	if dir == "" {
+		dir = config.Topics.DeadLetterDir
+	}
+	if dir == "" {
+		log.Fatal("dead letter directory required")
+	}
+
+	// stop at the first failure so the file is kept for the next replay
+	config.Topics.FailFast = true
+	config.Topics.DeadLetterDir = ""
+	// replayed records don't belong to a checkpoint so they're produced
+	// without a transaction which would never be committed
+	config.Topics.Transactional = false
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.bin"))
+	if err != nil {
+		log.Fatalf("unable to list dead letters: %+v", err)
+	}
+	for _, path := range paths {
+		err = os.Rename(path, path+replayingSuffix)
+		if err != nil {
+			log.Fatalf("unable to rename %s: %+v", path, err)
+		}
+	}
+
+	// include files left behind by a replay which failed
+	paths, err = filepath.Glob(filepath.Join(dir, "*.bin"+replayingSuffix))
+	if err != nil {
+		log.Fatalf("unable to list dead letters: %+v", err)
+	}
+	sort.Strings(paths)
+
+	producer, err := simulator.NewProducer(config.Topics, "replay")
+	if err != nil {
+		log.Fatalf("unable to create producer: %+v", err)
+	}
+	defer producer.Close()
+
+	total := 0
+	for _, path := range paths {
+		letters, err := simulator.ReadDeadLetters(path)
+		if err != nil {
+			log.Fatalf("unable to read dead letters: %+v", err)
+		}
+
+		for _, l := range letters {
+			b := simulator.NewRecordBuffer()
+			b.B = append(b.B, l.Value...)
+			err = producer.TopicWriter(l.Topic).WriteRecord(l.Key, b)
+			if err != nil {
+				log.Fatalf("unable to replay %s: %+v", path, err)
+			}
+		}
+		err = producer.Flush()
+		if err != nil {
+			log.Fatalf("unable to replay %s: %+v", path, err)
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			log.Fatalf("unable to remove %s: %+v", path, err)
+		}
+		log.Printf("replayed %d records from %s", len(letters), strings.TrimSuffix(path, replayingSuffix))
+		total += len(letters)
+	}
+	log.Printf("replayed %d records", total)
+}
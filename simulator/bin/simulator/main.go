@@ -3,14 +3,14 @@ package main
 import (
 	"container/heap"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"os"
 	"os/signal"
-	"runtime"
 	"runtime/pprof"
 	"simulator"
+	"simulator/registry"
 	"sync"
 	"syscall"
 	"time"
@@ -18,40 +18,31 @@ import (
 	"cuelang.org/go/pkg/strconv"
 )
 
-type FlagStringSlice []string
-
-func (f *FlagStringSlice) String() string {
-	return "[]string"
-}
-
-func (f *FlagStringSlice) Set(value string) error {
-	*f = append(*f, value)
-	return nil
-}
-
 func main() {
-	rand.Seed(time.Now().UnixNano())
-
-	configPaths := FlagStringSlice{}
+	configPaths := simulator.FlagStringSlice{}
 	cpuprofile := ""
 	simulatorID := ""
+	var seed int64
+	restore := false
 
 	flag.Var(&configPaths, "config", "path to the config file; can be provided multiple times, files will be merged in the order provided")
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "write cpu profile to `file`")
 	flag.StringVar(&simulatorID, "id", "", "The unique identifier for this simulator process - if multiple simulators are running, each must have a unique id")
+	flag.Int64Var(&seed, "seed", 0, "seed for the simulation's random number generators; overrides the seed config value")
+	flag.BoolVar(&restore, "restore", false, "resume each worker from its checkpoint rather than from the active packages in the database")
 
 	flag.Parse()
 
-	if len(configPaths) == 0 {
-		configPaths.Set("config.yaml")
-	}
-
 	log.SetFlags(log.Ldate | log.Ltime)
 
-	config, err := simulator.ParseConfigs([]string(configPaths))
+	config, err := simulator.ParseConfigFlags(configPaths)
 	if err != nil {
 		log.Fatalf("unable to load config files: %v; error: %+v", configPaths, err)
 	}
+	err = config.Validate()
+	if err != nil {
+		log.Fatalf("invalid config: %+v", err)
+	}
 
 	if cpuprofile != "" {
 		// disable logging and lower verbosity during profile
@@ -83,15 +74,26 @@ func main() {
 		config.Metrics.Port = int(metricsPort)
 	}
 
+	// set Seed from flag
+	if seed != 0 {
+		config.Seed = seed
+	}
+
+	// if still empty, pick one - it's logged below so the run can be reproduced
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+
 	log.Printf("Simulator ID: %s", config.SimulatorID)
+	log.Printf("Seed: %d", config.Seed)
 
 	go simulator.ExportMetrics(config.Metrics)
 
 	var db simulator.Database
 	for {
-		db, err = simulator.NewSingleStore(config.Database)
+		db, err = simulator.NewDatabase(config.Database)
 		if err != nil {
-			log.Printf("unable to connect to SingleStore: %s; retrying...", err)
+			log.Printf("unable to connect to database: %s; retrying...", err)
 			time.Sleep(time.Second)
 			continue
 		}
@@ -100,7 +102,7 @@ func main() {
 	defer db.Close()
 
 	// we need to wait for tables to exist since the simulator can start before
-	// the schema has been applied to SingleStore
+	// the schema has been applied to the database
 	for {
 		err := db.CheckTables()
 		if err != nil {
@@ -114,28 +116,95 @@ func main() {
 	if config.StartTime.IsZero() {
 		start, err := db.CurrentTime()
 		if err != nil {
-			log.Fatalf("unable to read current time from SingleStore: %+v", err)
+			log.Fatalf("unable to read current time from database: %+v", err)
 		}
 		config.StartTime = start
 	}
 
 	locations, err := db.Locations()
 	if err != nil {
-		log.Fatalf("unable to download locations from SingleStore: %+v", err)
+		log.Fatalf("unable to load locations from database: %+v", err)
 	}
 	index, err := simulator.NewLocationIndexFromDB(locations, config.Verbose >= simulator.VerboseSilly)
 	if err != nil {
 		log.Fatalf("unable to build location index: %+v", err)
 	}
 
-	packages, err := db.ActivePackages(config.SimulatorID)
+	index.ApplyCapacity(config.Capacity)
+
+	demand, err := simulator.NewDemandModel(config.Demand)
+	if err != nil {
+		log.Fatalf("unable to build demand model: %+v", err)
+	}
+
+	modes, err := simulator.NewTransportModels(config)
 	if err != nil {
-		log.Fatalf("unable to download packages from SingleStore: %+v", err)
+		log.Fatalf("unable to configure transport modes: %+v", err)
 	}
 
-	trackers, err := simulator.NewTrackersFromActivePackages(config, index, packages)
+	router, err := simulator.NewRouter(config, index, modes)
 	if err != nil {
-		log.Fatalf("unable to download locations from SingleStore: %+v", err)
+		log.Fatalf("unable to configure routing: %+v", err)
+	}
+
+	world := &simulator.World{
+		Locations: index,
+		Demand:    demand,
+		Modes:     modes,
+		Router:    router,
+	}
+	if config.Gravity.Enabled() {
+		world.Gravity = simulator.NewGravityModel(config.Gravity, index)
+	}
+	if config.Topics.Registry.Serve != "" {
+		r, err := registry.Open(config.Topics.Registry.File)
+		if err != nil {
+			log.Fatalf("unable to open schema registry: %+v", err)
+		}
+		url, err := registry.Serve(config.Topics.Registry.Serve, r)
+		if err != nil {
+			log.Fatalf("unable to start schema registry: %+v", err)
+		}
+		log.Printf("serving schema registry on %s", url)
+		if config.Topics.Registry.URL == "" {
+			config.Topics.Registry.URL = url
+		}
+	}
+	if config.Topics.Registry.URL != "" {
+		for {
+			world.SchemaIDs, err = simulator.RegisterSchemas(config.Topics.Registry.URL)
+			if err != nil {
+				log.Printf("unable to register schemas: %s; retrying...", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			break
+		}
+	}
+	if config.Partition.Enabled() {
+		world.Partition, err = simulator.NewPartition(config.Partition, index)
+		if err != nil {
+			log.Fatalf("unable to partition locations: %+v", err)
+		}
+		log.Printf("simulating region %s of %v", world.Partition.Region, world.Partition.Regions)
+	}
+
+	if restore && config.Checkpoint.Dir == "" {
+		log.Fatal("checkpoint dir required to restore")
+	}
+
+	// when restoring, each worker loads its trackers from its checkpoint instead
+	trackers := make(simulator.Trackers, 0)
+	if !restore {
+		packages, err := db.ActivePackages(config.SimulatorID)
+		if err != nil {
+			log.Fatalf("unable to load packages from database: %+v", err)
+		}
+
+		trackers, err = simulator.NewTrackersFromActivePackages(world, packages)
+		if err != nil {
+			log.Fatalf("unable to restore active packages: %+v", err)
+		}
 	}
 
 	// Trap SIGINT to trigger a shutdown.
@@ -153,11 +222,48 @@ func main() {
 		}
 	}()
 
-	numWorkers := runtime.NumCPU()
-	if config.NumWorkers != 0 {
-		numWorkers = config.NumWorkers
+	// packages handed off to our region are shared between the workers, or
+	// with transactional topics each worker consumes it's share in it's own
+	// transactions
+	var (
+		handoffs         chan *simulator.Tracker
+		handoffCloseCh   chan struct{}
+		unsentHandoffs   chan []*simulator.Tracker
+		handoffOffsets   *simulator.HandoffOffsets
+		consumer         simulator.Consumer
+		transactHandoffs = world.Partition != nil && config.Topics.ConsumesInTransactions()
+	)
+	if world.Partition != nil && !transactHandoffs {
+		for {
+			consumer, err = simulator.NewConsumer(config.Topics, simulator.HandoffTopic, "handoffs-"+world.Partition.Region)
+			if err != nil {
+				log.Printf("unable to create handoff consumer: %s; retrying...", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			break
+		}
+		defer func() {
+			if err := consumer.Close(); err != nil {
+				log.Printf("unable to close handoff consumer: %+v", err)
+			}
+		}()
+
+		bufferSize := config.Partition.HandoffBuffer
+		if bufferSize <= 0 {
+			bufferSize = 1024
+		}
+		handoffs = make(chan *simulator.Tracker, bufferSize)
+		handoffCloseCh = make(chan struct{})
+		unsentHandoffs = make(chan []*simulator.Tracker, 1)
+		handoffOffsets = simulator.NewHandoffOffsets()
+		go func() {
+			unsentHandoffs <- simulator.ConsumeHandoffs(consumer, handoffOffsets, world, handoffs, handoffCloseCh)
+		}()
 	}
 
+	numWorkers := config.Workers()
+
 	log.Printf("starting simulation at %s with %d workers", config.StartTime, numWorkers)
 
 	// start the cpu profile after we initialize everything so we measure the
@@ -176,18 +282,31 @@ func main() {
 
 	initTrackersPerWorker := len(trackers) / numWorkers
 	var initTrackers simulator.Trackers
+	states := make([]*simulator.State, 0, numWorkers)
 
 	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
 
+		// the last worker picks up the remainder
+		if i == numWorkers-1 {
+			initTrackersPerWorker = len(trackers)
+		}
 		initTrackers, trackers = trackers[:initTrackersPerWorker], trackers[initTrackersPerWorker:]
 		heap.Init(&initTrackers)
 
-		var producer simulator.Producer
+		var (
+			producer        simulator.Producer
+			handoffConsumer simulator.Consumer
+		)
 		for {
-			producer, err = simulator.NewFranzProducer(config.Topics)
+			name := fmt.Sprintf("%s-%d", config.SimulatorID, i)
+			if transactHandoffs {
+				producer, handoffConsumer, err = simulator.NewTransactProducer(config.Topics, name, simulator.HandoffTopic, "handoffs-"+world.Partition.Region)
+			} else {
+				producer, err = simulator.NewProducer(config.Topics, name)
+			}
 			if err != nil {
-				log.Printf("unable to connect to Redpanda: %s; retrying...", err)
+				log.Printf("unable to create producer: %s; retrying...", err)
 				time.Sleep(time.Second)
 				continue
 			}
@@ -195,8 +314,19 @@ func main() {
 		}
 		defer producer.Close()
 
-		state := simulator.NewState(config, index, producer, initTrackers)
+		state := simulator.NewState(config, i, world, producer, initTrackers)
+		if restore {
+			cp, err := simulator.LoadCheckpoint(state)
+			if err != nil {
+				log.Fatalf("unable to read checkpoint for worker %d: %+v", i, err)
+			}
+			state.Restore(cp)
+			log.Printf("worker %d restored %d packages at %s", i, state.Trackers.Len(), cp.Now)
+		}
+		state.Handoffs = handoffs
+		state.HandoffConsumer = handoffConsumer
 		closeChannels = append(closeChannels, state.CloseCh)
+		states = append(states, state)
 
 		go func(i int) {
 			defer wg.Done()
@@ -206,4 +336,48 @@ func main() {
 	}
 
 	wg.Wait()
+
+	// handoff offsets are only committed once the handed off packages are saved
+	handoffsSaved := false
+	if handoffs != nil {
+		// keep the packages which were handed off to us but not picked up by a worker
+		close(handoffCloseCh)
+		state := states[0]
+		for _, t := range <-unsentHandoffs {
+			simulator.AcceptHandoff(state, t)
+		}
+		simulator.AcceptHandoffs(state)
+		if config.Checkpoint.Dir != "" {
+			// every worker may have accepted handoffs since it's last checkpoint
+			for _, state := range states {
+				err = simulator.WriteCheckpoint(state)
+				if err != nil {
+					log.Fatalf("unable to checkpoint handed off packages: %+v", err)
+				}
+			}
+			handoffsSaved = true
+		}
+	}
+
+	if w, ok := db.(simulator.ActivePackageWriter); ok {
+		active := make([]simulator.DBActivePackage, 0)
+		for _, state := range states {
+			active = append(active, state.Trackers.ActivePackages()...)
+		}
+		err = w.WriteActivePackages(config.SimulatorID, active)
+		if err != nil {
+			log.Fatalf("unable to save active packages: %+v", err)
+		}
+		log.Printf("saved %d active packages", len(active))
+		handoffsSaved = true
+	}
+
+	if handoffOffsets != nil && handoffsSaved {
+		// every package handed off to us is saved now
+		handoffOffsets.SaveAll()
+		err = simulator.CommitHandoffs(consumer, handoffOffsets)
+		if err != nil {
+			log.Fatalf("unable to commit handoffs: %+v", err)
+		}
+	}
 }
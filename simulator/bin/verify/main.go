@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"simulator"
+	"time"
+)
+
+// verify reads the transitions topic from the start and checks the records of
+// each package are in order
+func main() {
+	configPaths := simulator.FlagStringSlice{}
+	idle := time.Duration(0)
+	allowSplit := false
+
+	flag.Var(&configPaths, "config", "path to the config file; can be provided multiple times, files will be merged in the order provided")
+	flag.DurationVar(&idle, "idle", 10*time.Second, "stop once no records have been read for this long")
+	flag.BoolVar(&allowSplit, "allow-split", false, "don't fail when a package's records are in more than one partition")
+
+	flag.Parse()
+
+	log.SetFlags(log.Ldate | log.Ltime)
+
+	config, err := simulator.ParseConfigFlags(configPaths)
+	if err != nil {
+		log.Fatalf("unable to load config files: %v; error: %+v", configPaths, err)
+	}
+
+	schemaIDs, err := simulator.SchemaIDsFromConfig(&config.Topics)
+	if err != nil {
+		log.Fatalf("unable to read schema ids: %+v", err)
+	}
+
+	consumer, err := simulator.NewConsumer(config.Topics, "transitions", "")
+	if err != nil {
+		log.Fatalf("unable to create consumer: %+v", err)
+	}
+	defer consumer.Close()
+
+	verifier := simulator.NewOrderVerifier(schemaIDs, config.Topics.Partitioner)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), idle)
+		records, err := consumer.Poll(ctx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Fatalf("failed to read transitions: %+v", err)
+		}
+		if len(records) == 0 && ctx.Err() != nil {
+			break
+		}
+		for _, r := range records {
+			verifier.Add(r)
+		}
+	}
+
+	verifier.Report(os.Stdout)
+	if verifier.Failed(allowSplit) {
+		os.Exit(1)
+	}
+}
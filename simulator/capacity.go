@@ -0,0 +1,186 @@
+package simulator
+
+import (
+	"log"
+	"time"
+
+	"simulator/enum"
+)
+
+const (
+	FIFOQueue     = "fifo"
+	PriorityQueue = "priority"
+)
+
+type CapacityConfig struct {
+	// HubPerMillion is the throughput (packages/hour) of a hub per million people
+	HubPerMillion float64 `yaml:"hub_per_million"`
+
+	// Point is the throughput (packages/hour) of a point
+	Point float64 `yaml:"point"`
+
+	// Overrides sets the throughput (packages/hour) of specific locations by id
+	Overrides map[int64]float64 `yaml:"overrides"`
+
+	// Queue determines the order in which packages leave a saturated location
+	// fifo (default): in the order they are ready
+	// priority: express packages skip ahead of standard packages
+	Queue string `yaml:"queue"`
+}
+
+// ApplyCapacity sets the capacity of every location in the index
+// a capacity of 0 means the location can process an unlimited number of packages
+func (idx *LocationIndex) ApplyCapacity(c CapacityConfig) {
+	for _, loc := range idx.popSorted {
+		switch loc.Kind {
+		case enum.Hub:
+			loc.Capacity = c.HubPerMillion * float64(loc.Population) / 1e6
+		case enum.Point:
+			loc.Capacity = c.Point
+		}
+		if capacity, ok := c.Overrides[loc.LocationID]; ok {
+			loc.Capacity = capacity
+		}
+	}
+}
+
+// HubQueue tracks when a location is able to process its next package
+// BusyUntil is the end of the location's timeline which every package shares
+// when express packages skip ahead they're inserted into the timeline ahead of
+// standard packages which already reserved a slot; Preemptions records where
+// they were inserted so the standard packages can be moved back one slot each
+// PreemptionBase counts the preemptions which were pruned
+// InServiceUntil is the end of the slot of the last package which departed;
+// express packages can't take it's place
+type HubQueue struct {
+	BusyUntil        time.Time
+	ExpressBusyUntil time.Time
+	InServiceUntil   time.Time
+
+	Preemptions    []Preemption
+	PreemptionBase int
+}
+
+// Preemption is an express package inserted into the timeline at Slot
+// BusyUntil is the end of the timeline before it was inserted, so every
+// standard package which reserved a slot before it is due before BusyUntil
+type Preemption struct {
+	Slot      time.Time
+	BusyUntil time.Time
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// mark returns the number of preemptions so far
+func (q *HubQueue) mark() int {
+	return q.PreemptionBase + len(q.Preemptions)
+}
+
+// prune drops the preemptions which can't move back a waiting package
+// a standard package takes a new mark when it's due, so once ready passes a
+// preemption's BusyUntil every package which reserved a slot before it has
+func (q *HubQueue) prune(ready time.Time) {
+	n := 0
+	for n < len(q.Preemptions) && !q.Preemptions[n].BusyUntil.After(ready) {
+		n++
+	}
+	q.PreemptionBase += n
+	q.Preemptions = q.Preemptions[n:]
+}
+
+// preempted returns the slot a standard package holds once it's moved back
+// by the express packages inserted ahead of it since it reserved the slot
+func (q *HubQueue) preempted(slot time.Time, mark int, service time.Duration) time.Time {
+	for i := mark - q.PreemptionBase; i < len(q.Preemptions); i++ {
+		if i >= 0 && q.Preemptions[i].Slot.Before(slot.Add(service)) {
+			slot = slot.Add(service)
+		}
+	}
+	return slot
+}
+
+// ReserveProcessing reserves a slot for the tracker to be processed at it's
+// current location. Returns true if the tracker can depart now, otherwise the
+// tracker's NextTransitionTime is moved to the reserved slot.
+func ReserveProcessing(state *State, t *Tracker) bool {
+	loc, err := state.Locations.Lookup(t.LastLocationID)
+	if err != nil {
+		log.Panic(err)
+	}
+	if loc.Capacity <= 0 {
+		t.Queued = false
+		return true
+	}
+
+	// each worker processes it's share of the location's capacity
+	service := time.Duration(float64(time.Hour) / (loc.Capacity * state.CapacityShare))
+
+	q, ok := state.Queues[loc.LocationID]
+	if !ok {
+		q = &HubQueue{}
+		state.Queues[loc.LocationID] = q
+	}
+
+	ready := t.NextTransitionTime
+	express := state.PriorityQueue && t.Method == enum.Express
+	q.prune(ready)
+
+	// the tracker is leaving in the slot it reserved earlier unless express
+	// packages were inserted ahead of it
+	if t.Queued {
+		slot := ready
+		if !express {
+			slot = q.preempted(ready, t.QueueMark, service)
+		}
+		if !slot.After(ready) {
+			t.Queued = false
+			q.InServiceUntil = maxTime(q.InServiceUntil, ready.Add(service))
+			return true
+		}
+		return queue(state, t, q, loc, ready, slot)
+	}
+
+	var slot time.Time
+	if express {
+		slot = maxTime(ready, maxTime(q.ExpressBusyUntil, q.InServiceUntil))
+		q.ExpressBusyUntil = slot.Add(service)
+
+		if slot.Before(q.BusyUntil) {
+			// the slot belongs to a standard package which moves back along
+			// with every standard package after it
+			q.Preemptions = append(q.Preemptions, Preemption{Slot: slot, BusyUntil: q.BusyUntil})
+			q.BusyUntil = q.BusyUntil.Add(service)
+		} else {
+			q.BusyUntil = slot.Add(service)
+		}
+	} else {
+		slot = maxTime(ready, q.BusyUntil)
+		q.BusyUntil = slot.Add(service)
+	}
+
+	if !slot.After(ready) {
+		q.InServiceUntil = maxTime(q.InServiceUntil, ready.Add(service))
+		return true
+	}
+	return queue(state, t, q, loc, ready, slot)
+}
+
+// queue makes the tracker wait for it's slot
+func queue(state *State, t *Tracker, q *HubQueue, loc *Location, ready time.Time, slot time.Time) bool {
+	if state.Verbose >= VerboseDebug {
+		log.Printf("Queued(%s): %s; waiting %s",
+			t.PackageID.String()[:8],
+			PointString(loc.Position),
+			slot.Sub(ready))
+	}
+
+	t.Queued = true
+	t.QueueMark = q.mark()
+	t.NextTransitionTime = slot
+	return false
+}
@@ -0,0 +1,147 @@
+package simulator
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"simulator/enum"
+)
+
+// processQueue runs trackers through a location with a capacity of one
+// package per hour in the order they become due and returns the hour each
+// tracker departed
+func processQueue(t *testing.T, priority bool, arrivals []queueArrival) ([]float64, *HubQueue) {
+	t.Helper()
+
+	index, err := NewLocationIndexFromDB([]DBLocation{{LocationID: 1, Kind: enum.Hub, Population: 1e6}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.ApplyCapacity(CapacityConfig{HubPerMillion: 1})
+	state := &State{
+		Locations:     index,
+		Queues:        make(map[int64]*HubQueue),
+		CapacityShare: 1,
+		PriorityQueue: priority,
+	}
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	trackers := make([]*Tracker, len(arrivals))
+	for i, a := range arrivals {
+		trackers[i] = &Tracker{
+			Method:             a.method,
+			LastLocationID:     1,
+			NextTransitionTime: start.Add(time.Duration(a.hour * float64(time.Hour))),
+		}
+	}
+
+	departed := make([]float64, len(trackers))
+	for remaining := len(trackers); remaining > 0; remaining-- {
+		// the earliest due tracker, ties in order of arrival
+		next := -1
+		for i, tr := range trackers {
+			if tr != nil && (next < 0 || tr.NextTransitionTime.Before(trackers[next].NextTransitionTime)) {
+				next = i
+			}
+		}
+		tr := trackers[next]
+		if !ReserveProcessing(state, tr) {
+			remaining++
+			continue
+		}
+		departed[next] = tr.NextTransitionTime.Sub(start).Hours()
+		trackers[next] = nil
+	}
+	return departed, state.Queues[1]
+}
+
+type queueArrival struct {
+	hour   float64
+	method enum.DeliveryMethod
+}
+
+func TestReserveProcessing(t *testing.T) {
+	std := func(hour float64) queueArrival { return queueArrival{hour, enum.Standard} }
+	exp := func(hour float64) queueArrival { return queueArrival{hour, enum.Express} }
+
+	for _, c := range []struct {
+		name     string
+		priority bool
+		arrivals []queueArrival
+		departed []float64
+	}{
+		{
+			name:     "below capacity",
+			arrivals: []queueArrival{std(0), std(1), std(2.5)},
+			departed: []float64{0, 1, 2.5},
+		},
+		{
+			name:     "saturated fifo",
+			arrivals: []queueArrival{std(0), std(0), exp(0.5), std(0.5)},
+			departed: []float64{0, 1, 2, 3},
+		},
+		{
+			name:     "express skips standard packages",
+			priority: true,
+			arrivals: []queueArrival{std(0), std(0), std(0), exp(0.5)},
+			departed: []float64{0, 2, 3, 1},
+		},
+		{
+			name:     "express packages keep their order",
+			priority: true,
+			arrivals: []queueArrival{std(0), std(0), exp(0.25), exp(0.5), std(0.75)},
+			departed: []float64{0, 3, 1, 2, 4},
+		},
+		{
+			name:     "express package after the queue drained",
+			priority: true,
+			arrivals: []queueArrival{std(0), std(0), exp(0.5), std(5), exp(5.5)},
+			departed: []float64{0, 2, 1, 5, 6},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			departed, q := processQueue(t, c.priority, c.arrivals)
+			if fmt.Sprint(departed) != fmt.Sprint(c.departed) {
+				t.Errorf("expected departures at %v, got %v", c.departed, departed)
+			}
+			if len(q.Preemptions) != 0 {
+				t.Errorf("expected the preemptions to be reset once the queue drained, got %d", len(q.Preemptions))
+			}
+		})
+	}
+}
+
+func TestReserveProcessingSaturated(t *testing.T) {
+	// after a backlog packages arrive as fast as the location processes them,
+	// so the queue never drains
+	arrivals := make([]queueArrival, 0)
+	for i := 0; i < 5; i++ {
+		arrivals = append(arrivals, queueArrival{0, enum.Standard})
+	}
+	for hour := 0.0; hour < 2000; hour += 4 {
+		arrivals = append(arrivals,
+			queueArrival{hour, enum.Standard},
+			queueArrival{hour + 0.1, enum.Standard},
+			queueArrival{hour + 0.2, enum.Standard},
+			queueArrival{hour + 0.5, enum.Express},
+		)
+	}
+
+	departed, q := processQueue(t, true, arrivals)
+	for i, hour := range departed {
+		if wait := hour - arrivals[i].hour; wait < 0 || wait > 10 {
+			t.Fatalf("package %d arrived at %.2f and departed at %.2f", i, arrivals[i].hour, hour)
+		}
+	}
+	for i := 1; i < len(departed); i++ {
+		for j := 0; j < i; j++ {
+			if departed[i] == departed[j] {
+				t.Fatalf("packages %d and %d departed in the same slot at %.2f", j, i, departed[i])
+			}
+		}
+	}
+	if q.PreemptionBase == 0 || len(q.Preemptions) > 10 {
+		t.Errorf("expected preemptions to be pruned, %d pruned and %d left", q.PreemptionBase, len(q.Preemptions))
+	}
+}
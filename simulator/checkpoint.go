@@ -0,0 +1,231 @@
+package simulator
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+
+	"simulator/enum"
+)
+
+// Checkpoint contains everything needed to resume a worker exactly where it stopped
+type Checkpoint struct {
+	Now            time.Time
+	TotalDelivered int
+	Trackers       Trackers
+	Queues         map[int64]*HubQueue
+
+	PendingShipments map[uuid.UUID]*Shipment
+	Lanes            map[Lane]*LaneSchedule
+
+	Calibration    map[enum.DeliveryMethod]float64
+	ExceptionRates ExceptionRates
+	Arrivals       Arrivals
+
+	// Seed is used to reseed the worker's random source when the checkpoint is
+	// taken, which lets a restored worker continue with the same random sequence
+	Seed int64
+
+	// Seq numbers the checkpoints committed with transactional topics
+	Seq int64
+}
+
+// CheckpointMarker is committed with the records produced before a checkpoint
+// it identifies the checkpoint a worker has to resume from
+type CheckpointMarker struct {
+	SimulatorID string
+	Seq         int64
+	Now         time.Time
+}
+
+// CheckpointPath returns the path of the checkpoint file for a worker
+func CheckpointPath(dir string, simulatorID string, worker int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%d.ckpt", simulatorID, worker))
+}
+
+// transactionalCheckpointPath returns the path of a numbered checkpoint
+// with transactional topics a new file is written for every checkpoint, and
+// the last committed marker picks the one to resume from
+func transactionalCheckpointPath(path string, seq int64) string {
+	return fmt.Sprintf("%s.%d", path, seq)
+}
+
+// WriteCheckpoint flushes the worker's topics and atomically replaces its checkpoint file
+// with transactional topics the checkpoint is committed with the records
+// written since the last checkpoint instead
+func WriteCheckpoint(state *State) error {
+	transactional := state.Topics.Transactional()
+	if !transactional {
+		err := state.Topics.Flush()
+		if err != nil {
+			return errors.Wrap(err, "failed to flush topics")
+		}
+	}
+
+	cp := Checkpoint{
+		Now:            state.Clock.Now(),
+		TotalDelivered: state.TotalDelivered,
+		Trackers:       state.Trackers,
+		Queues:         state.Queues,
+
+		PendingShipments: state.PendingShipments,
+		Lanes:            state.Lanes,
+		Calibration:      state.Estimator.Calibration,
+		ExceptionRates:   state.ExceptionRates,
+		Arrivals:         state.Arrivals,
+		Seed:             state.Rand.Int63(),
+		Seq:              state.checkpointSeq + 1,
+	}
+	state.Rand.Seed(cp.Seed)
+
+	path := state.CheckpointPath
+	if transactional {
+		path = transactionalCheckpointPath(path, cp.Seq)
+	}
+	err := writeCheckpointFile(path, &cp)
+	if err != nil {
+		return err
+	}
+
+	if transactional {
+		err = state.Topics.Commit(&CheckpointMarker{
+			SimulatorID: state.SimulatorID,
+			Seq:         cp.Seq,
+			Now:         cp.Now,
+		})
+		if errors.Cause(err) == ErrTransactionAborted {
+			// the checkpoint can't be resumed from
+			if rmErr := os.Remove(path); rmErr != nil {
+				return errors.WithStack(rmErr)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		// the previous checkpoint can't be resumed from anymore
+		err = os.Remove(transactionalCheckpointPath(state.CheckpointPath, state.checkpointSeq))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	state.checkpointSeq = cp.Seq
+
+	// the handed off packages are in the checkpoint so the consumer can move past them
+	saveHandoffs(state.handoffs)
+	state.handoffs = nil
+	return nil
+}
+
+// writeCheckpointFile atomically replaces the checkpoint file at path
+func writeCheckpointFile(path string, cp *Checkpoint) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	err = gob.NewEncoder(f).Encode(cp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmpPath, path))
+}
+
+// LoadCheckpoint reads the checkpoint the worker should resume from
+// with transactional topics it's the checkpoint of the last commit
+func LoadCheckpoint(state *State) (*Checkpoint, error) {
+	if !state.Topics.Transactional() {
+		return ReadCheckpoint(state.CheckpointPath)
+	}
+
+	m, err := state.Topics.LastCommit()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read last commit")
+	}
+	if m == nil {
+		return nil, errors.New("no checkpoint has been committed")
+	}
+	return ReadCheckpoint(transactionalCheckpointPath(state.CheckpointPath, m.Seq))
+}
+
+// RestoreLastCommit resets the worker to the checkpoint of it's last commit
+// after a transaction was aborted
+// a worker which hasn't committed anything yet is left as it is
+func RestoreLastCommit(state *State) error {
+	if state.checkpointSeq == 0 {
+		return nil
+	}
+	cp, err := ReadCheckpoint(transactionalCheckpointPath(state.CheckpointPath, state.checkpointSeq))
+	if err != nil {
+		return err
+	}
+	state.Restore(cp)
+	return nil
+}
+
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var cp Checkpoint
+	err = gob.NewDecoder(f).Decode(&cp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to decode checkpoint %s", path)
+	}
+
+	return &cp, nil
+}
+
+// Restore resets the state to the point where the checkpoint was taken
+func (s *State) Restore(cp *Checkpoint) {
+	s.Clock.Set(cp.Now)
+	s.TotalDelivered = cp.TotalDelivered
+	s.Trackers = cp.Trackers
+	heap.Init(&s.Trackers)
+	s.Queues = cp.Queues
+	if s.Queues == nil {
+		s.Queues = make(map[int64]*HubQueue)
+	}
+	s.PendingShipments = cp.PendingShipments
+	if s.PendingShipments == nil {
+		s.PendingShipments = make(map[uuid.UUID]*Shipment)
+	}
+	s.Lanes = cp.Lanes
+	if s.Lanes == nil {
+		s.Lanes = make(map[Lane]*LaneSchedule)
+	}
+	s.ExceptionRates = cp.ExceptionRates
+	s.Arrivals = cp.Arrivals
+	if cp.Calibration != nil {
+		s.Estimator.Calibration = cp.Calibration
+	}
+	s.Rand.Seed(cp.Seed)
+	s.checkpointSeq = cp.Seq
+
+	s.nextCheckpoint = cp.Now.Add(s.CheckpointInterval)
+}
@@ -0,0 +1,75 @@
+package simulator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// abortingProducer aborts it's transactions while abort is set, as a producer
+// whose handoff partitions were reassigned does
+type abortingProducer struct {
+	*FileProducer
+	abort bool
+}
+
+func (p *abortingProducer) Commit(marker *RecordBuffer) error {
+	if p.abort {
+		marker.Release()
+		return ErrTransactionAborted
+	}
+	return p.FileProducer.Commit(marker)
+}
+
+func TestCheckpointAbortedTransaction(t *testing.T) {
+	dir := t.TempDir()
+	fp, err := NewFileProducer(filepath.Join(dir, "topics"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	producer := &abortingProducer{FileProducer: fp}
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := &Config{
+		SimulatorID: "test",
+		StartTime:   start,
+		Seed:        1,
+		Checkpoint:  CheckpointConfig{Dir: dir, Interval: time.Hour},
+	}
+	state := NewState(config, 0, &World{}, producer, Trackers{})
+
+	checkpoint(state)
+	if state.checkpointSeq != 1 {
+		t.Fatalf("expected checkpoint 1 to be committed, got %d", state.checkpointSeq)
+	}
+
+	// the worker moves on, but the next transaction is aborted
+	state.Clock.Set(start.Add(time.Hour))
+	state.TotalDelivered = 3
+	state.Trackers.PushTracker(&Tracker{PackageID: uuid.NewV4(), NextTransitionTime: start.Add(2 * time.Hour)})
+
+	producer.abort = true
+	checkpoint(state)
+
+	if state.checkpointSeq != 1 || !state.Clock.Now().Equal(start) || state.TotalDelivered != 0 || state.Trackers.Len() != 0 {
+		t.Errorf("expected the worker to resume from checkpoint 1 at %s, got checkpoint %d at %s with %d delivered and %d tracked",
+			start, state.checkpointSeq, state.Clock.Now(), state.TotalDelivered, state.Trackers.Len())
+	}
+	if _, err := os.Stat(transactionalCheckpointPath(state.CheckpointPath, 2)); !os.IsNotExist(err) {
+		t.Errorf("expected the aborted checkpoint to be removed, got %v", err)
+	}
+
+	producer.abort = false
+	checkpoint(state)
+	m, err := state.Topics.LastCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil || m.Seq != 2 || state.checkpointSeq != 2 {
+		t.Errorf("expected checkpoint 2 to be committed, got %+v", m)
+	}
+}
@@ -5,8 +5,14 @@ import (
 )
 
 // Clock keeps track of the simulator's current time
+// when scale is set the clock is locked to the wall clock, with simulated time
+// passing scale times faster than real time
 type Clock struct {
 	now time.Time
+
+	scale     float64
+	simStart  time.Time
+	wallStart time.Time
 }
 
 func NewClock(start time.Time) *Clock {
@@ -29,3 +35,42 @@ func (c *Clock) Set(t time.Time) {
 func (c *Clock) Now() time.Time {
 	return c.now
 }
+
+// RealTime locks the clock to the wall clock starting now
+// scale is the number of simulated seconds per real second; 0 disables real time
+func (c *Clock) RealTime(scale float64) {
+	c.scale = scale
+	c.simStart = c.now
+	c.wallStart = time.Now()
+}
+
+// IsRealTime returns true if the clock is locked to the wall clock
+func (c *Clock) IsRealTime() bool {
+	return c.scale > 0
+}
+
+// WaitUntil blocks until the simulated time t arrives on the scaled wall clock
+// returns immediately unless the clock is in real time mode
+// returns false if closeCh is closed while waiting
+func (c *Clock) WaitUntil(t time.Time, closeCh <-chan struct{}) bool {
+	if c.scale <= 0 {
+		return true
+	}
+
+	deadline := c.wallStart.Add(time.Duration(float64(t.Sub(c.simStart)) / c.scale))
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		// we are behind, so emit the event immediately
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-closeCh:
+		return false
+	}
+}
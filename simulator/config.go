@@ -1,14 +1,28 @@
 package simulator
 
 import (
+	"fmt"
 	"os"
+	"runtime"
+	"sort"
 	"time"
 
-	"gonum.org/v1/gonum/stat/distuv"
+	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
+
+	"simulator/enum"
 )
 
 type DatabaseConfig struct {
+	// Backend selects where locations and active packages are loaded from: singlestore (default) or file
+	Backend string `yaml:"backend"`
+
+	// LocationsFile is the simplemaps worldcities csv loaded by the file backend
+	LocationsFile string `yaml:"locations_file"`
+
+	// SnapshotDir is where the file backend stores active packages between runs
+	SnapshotDir string `yaml:"snapshot_dir"`
+
 	Host     string `yaml:"host"`
 	Port     int    `yaml:"port"`
 	Username string `yaml:"username"`
@@ -17,25 +31,77 @@ type DatabaseConfig struct {
 }
 
 type TopicsConfig struct {
+	// Backend selects where records are written: kafka (default), file or memory
+	Backend string `yaml:"backend"`
+
+	// Directory is where the file backend writes its topic files
+	Directory string `yaml:"directory"`
+
 	Brokers       []string `yaml:"brokers"`
 	Compression   bool     `yaml:"compression"`
 	BatchMaxBytes int      `yaml:"batch_max_bytes"`
+
+	// MaxBufferedRecords limits the records waiting to be produced
+	// writing more blocks the simulation until records are produced
+	MaxBufferedRecords int `yaml:"max_buffered_records"`
+
+	// ProduceRetries limits how many times a record is retried, 0 retries forever
+	ProduceRetries int `yaml:"produce_retries"`
+
+	// RecordTimeout fails records which haven't been produced in time, 0 waits forever
+	RecordTimeout time.Duration `yaml:"record_timeout"`
+
+	// FailFast stops the simulator when a record fails rather than continuing
+	// with the record written to the dead letter directory
+	FailFast bool `yaml:"fail_fast"`
+
+	// DeadLetterDir is where records which couldn't be produced are written
+	// so they can be replayed; they are dropped when it's empty
+	DeadLetterDir string `yaml:"dead_letter_dir"`
+
+	// Transactional produces each worker's records in transactions committed
+	// along with it's checkpoints, so a restored worker resumes without
+	// duplicate or missing records
+	// records are only visible to read committed consumers once committed
+	Transactional bool `yaml:"transactional"`
+
+	// TransactionTimeout is how long a transaction may stay open, it has to
+	// be longer than the time between checkpoints
+	TransactionTimeout time.Duration `yaml:"transaction_timeout"`
+
+	// Partitioner selects the key used to pick each record's partition:
+	// package (default), region or simulator
+	// records are always keyed by their package so the records of a package
+	// stay in order whichever partitioner is used
+	Partitioner string `yaml:"partitioner"`
+
+	// Registry registers the schema of each topic with a schema registry
+	Registry RegistryConfig `yaml:"schema_registry"`
 }
 
-type MetricsConfig struct {
-	Port int `yaml:"port"`
+type RegistryConfig struct {
+	// URL of a Confluent compatible schema registry
+	// when set records are prefixed by a magic byte and the id of their schema
+	URL string `yaml:"url"`
+
+	// Serve starts the embedded schema registry on this address
+	// URL defaults to the embedded registry when it's running
+	Serve string `yaml:"serve"`
+
+	// File persists the schemas registered with the embedded registry
+	File string `yaml:"file"`
 }
 
-type NormalDistribution struct {
-	Avg    float64 `yaml:"avg"`
-	Stddev float64 `yaml:"stddev"`
+type CheckpointConfig struct {
+	// Dir is where each worker writes its checkpoint; leave empty to disable checkpoints
+	Dir string `yaml:"dir"`
+
+	// Interval is the amount of simulated time between checkpoints
+	Interval time.Duration `yaml:"interval"`
 }
 
-func (n *NormalDistribution) ToDist() *distuv.Normal {
-	return &distuv.Normal{
-		Mu:    n.Avg,
-		Sigma: n.Stddev,
-	}
+type MetricsConfig struct {
+	Port int `yaml:"port"`
 }
 
 type Config struct {
@@ -44,6 +110,12 @@ type Config struct {
 	// SimulatorID must be a unique identifier for this process - if multiple simulators are running, each must have a unique id
 	SimulatorID string `yaml:"id"`
 
+	// Seed controls all of the randomness in the simulation
+	// each worker derives its own random source from this value, so two runs
+	// with the same seed, start time, config and locations produce identical output
+	// set to 0 to pick a seed based on the current time
+	Seed int64 `yaml:"seed"`
+
 	// NumWorkers controls the number of goroutines which will run the simulator
 	// set to 0 to use the number of cores on the machine
 	NumWorkers int `yaml:"num_workers"`
@@ -52,13 +124,25 @@ type Config struct {
 	// set to 0 to cause the simulator to run as fast as possible
 	SimInterval time.Duration `yaml:"sim_interval"`
 
+	// TimeScale locks simulated time to the wall clock: each event is emitted
+	// when it's time arrives, with simulated time passing TimeScale times faster
+	// than real time (1 = real time, 60 = a simulated minute per second)
+	// set to 0 to disable; SimInterval is ignored when set
+	TimeScale float64 `yaml:"time_scale"`
+
 	StartTime time.Time `yaml:"start_time"`
 
 	MaxPackages  int `yaml:"max_packages"`
 	MaxDelivered int `yaml:"max_delivered"`
 
-	PackagesPerTick NormalDistribution `yaml:"packages_per_tick"`
-	HoursAtRest     NormalDistribution `yaml:"hours_at_rest"`
+	// PackagesPerTick is the average number of packages received per simulated hour
+	// it's redrawn at the start of each hour
+	PackagesPerTick DistributionConfig `yaml:"packages_per_tick"`
+	HoursAtRest     DistributionConfig `yaml:"hours_at_rest"`
+
+	// Demand shapes PackagesPerTick over time and across origins
+	// the configured models are multiplied together
+	Demand []DemandConfig `yaml:"demand"`
 
 	// ProbabilityExpress measures the probability that a package is shipped express
 	// should be a value between 0 and 1
@@ -68,6 +152,36 @@ type Config struct {
 	// (in terms of linear distance between origin and destination)
 	MinShippingDistanceKM float64 `yaml:"min_shipping_distance_km"`
 
+	// Gravity selects destinations based on population, distance and country
+	// when disabled destinations are selected independently of the origin
+	Gravity GravityConfig `yaml:"gravity"`
+
+	// Capacity limits the number of packages each location can process per hour
+	Capacity CapacityConfig `yaml:"capacity"`
+
+	// Shipments consolidates packages onto scheduled vehicles
+	Shipments ShipmentsConfig `yaml:"shipments"`
+
+	// Exceptions configures the probability of delays, misroutes, damage, loss
+	// and failed delivery attempts
+	Exceptions ExceptionsConfig `yaml:"exceptions"`
+
+	// Returns sends a fraction of delivered packages back to their origin
+	Returns ReturnsConfig `yaml:"returns"`
+
+	// Estimate configures how delivery estimates are calculated
+	Estimate EstimateConfig `yaml:"estimate"`
+
+	// Routing selects how packages are routed through the network
+	Routing RoutingConfig `yaml:"routing"`
+
+	// Partition splits the locations into regions simulated by separate processes
+	Partition PartitionConfig `yaml:"partition"`
+
+	// Modes configures the available modes of transportation
+	// when empty, land and air are configured from the settings below
+	Modes map[enum.TransportMode]ModeConfig `yaml:"modes"`
+
 	// MinAirFreightDistanceKM is the minimum distance (km) that we will send packages by air
 	MinAirFreightDistanceKM float64 `yaml:"min_air_freight_distance_km"`
 
@@ -77,9 +191,105 @@ type Config struct {
 	// AvgAirSpeedKMPH is the average speed (km/h) for air transportation
 	AvgAirSpeedKMPH float64 `yaml:"avg_air_speed_kmph"`
 
-	Database DatabaseConfig `yaml:"database"`
-	Topics   TopicsConfig   `yaml:"topics"`
-	Metrics  MetricsConfig  `yaml:"metrics"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Topics     TopicsConfig     `yaml:"topics"`
+	Checkpoint CheckpointConfig `yaml:"checkpoint"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+}
+
+// Workers returns the number of workers to run
+func (c *Config) Workers() int {
+	if c.NumWorkers != 0 {
+		return c.NumWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// Validate returns an error if any of the configured distributions are invalid
+func (c *Config) Validate() error {
+	if c.TimeScale < 0 {
+		return errors.New("time_scale must not be negative")
+	}
+	if c.Topics.MaxBufferedRecords < 0 {
+		return errors.New("topics.max_buffered_records must not be negative")
+	}
+	if c.Topics.ProduceRetries < 0 {
+		return errors.New("topics.produce_retries must not be negative")
+	}
+	if c.Topics.Transactional {
+		if c.Topics.Backend != "" && c.Topics.Backend != KafkaBackend && c.Topics.Backend != FileBackend {
+			return errors.Errorf("topics backend '%s' can't be transactional", c.Topics.Backend)
+		}
+		if c.Checkpoint.Dir == "" {
+			return errors.New("transactional topics require checkpoint.dir")
+		}
+	}
+	// handed off packages were created by another simulator so SingleStore
+	// doesn't restore them; only checkpoints and the file database's snapshot do
+	if c.Partition.Enabled() && c.Checkpoint.Dir == "" && c.Database.Backend != FileDatabaseBackend {
+		return errors.New("partition requires checkpoint.dir unless the database backend is file")
+	}
+	if err := validatePartitioner(c.Topics.Partitioner); err != nil {
+		return errors.Wrap(err, "topics.partitioner")
+	}
+	for i, d := range c.Demand {
+		// unset multipliers would stop all demand on weekdays or weekends
+		if d.Type == "weekly" && (d.Weekday <= 0 || d.Weekend <= 0) {
+			return errors.Errorf("demand[%d]: weekly demand requires positive weekday and weekend multipliers", i)
+		}
+	}
+
+	distributions := map[string]DistributionConfig{
+		"packages_per_tick":                  c.PackagesPerTick,
+		"hours_at_rest":                      c.HoursAtRest,
+		"exceptions.delay":                   c.Exceptions.Delay,
+		"exceptions.delay_hours":             c.Exceptions.DelayHours,
+		"exceptions.damaged":                 c.Exceptions.Damaged,
+		"exceptions.damaged_hours":           c.Exceptions.DamagedHours,
+		"exceptions.misrouted":               c.Exceptions.Misrouted,
+		"exceptions.lost":                    c.Exceptions.Lost,
+		"exceptions.delivery_attempt_failed": c.Exceptions.DeliveryAttemptFailed,
+		"returns.delay_hours":                c.Returns.DelayHours,
+	}
+	for mode, m := range c.Modes {
+		distributions[fmt.Sprintf("modes.%s.speed_kmph", mode)] = m.Speed
+	}
+
+	// sort the names so the same error is reported on every run
+	names := make([]string, 0, len(distributions))
+	for name := range distributions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		d := distributions[name]
+		if err := d.Validate(); err != nil {
+			return errors.Wrap(err, name)
+		}
+	}
+	return nil
+}
+
+// FlagStringSlice is a flag which can be provided multiple times
+type FlagStringSlice []string
+
+func (f *FlagStringSlice) String() string {
+	return "[]string"
+}
+
+func (f *FlagStringSlice) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// ParseConfigFlags merges the config files given with -config, or config.yaml
+// when none were given
+func ParseConfigFlags(configPaths FlagStringSlice) (*Config, error) {
+	if len(configPaths) == 0 {
+		configPaths = FlagStringSlice{"config.yaml"}
+	}
+	return ParseConfigs([]string(configPaths))
 }
 
 func ParseConfigs(filenames []string) (*Config, error) {
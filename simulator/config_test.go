@@ -0,0 +1,24 @@
+package simulator
+
+import "testing"
+
+func TestValidatePartitionPersistence(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		config Config
+		valid  bool
+	}{
+		{"singlestore", Config{}, false},
+		{"checkpoints", Config{Checkpoint: CheckpointConfig{Dir: "checkpoints"}}, true},
+		{"file database", Config{Database: DatabaseConfig{Backend: FileDatabaseBackend}}, true},
+	} {
+		c.config.Partition = PartitionConfig{Region: "europe"}
+		err := c.config.Validate()
+		if c.valid && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected handed off packages without a way to save them to be rejected", c.name)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package simulator
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// filePollInterval is how often the file backend checks for new records
+const filePollInterval = 100 * time.Millisecond
+
+// ConsumedRecord is a record read from a topic
+type ConsumedRecord struct {
+	// Partition identifies the ordered stream the record was read from
+	Partition string
+
+	// Offset is committed to resume reading after the record
+	Offset int64
+
+	// Key is nil for backends which don't store keys
+	// PartitionKey is the value the producer hashed to choose the record's
+	// partition, it's nil when the record wasn't given one
+	Key          []byte
+	PartitionKey []byte
+	Value        []byte
+}
+
+type Consumer interface {
+	// Poll blocks until records are available or ctx is done
+	// records from the same partition are returned in the order they were written
+	Poll(ctx context.Context) ([]ConsumedRecord, error)
+
+	// Commit saves the group's offset in each partition so the next consumer in
+	// the group resumes from there
+	// offsets maps a partition to the Offset of the last record to skip
+	Commit(offsets map[string]int64) error
+
+	Close() error
+}
+
+// NewConsumer creates a Consumer reading topic from the backend selected in config
+// consumers sharing a group share the topic's records; each group reads every record
+// offsets are only saved when they're committed
+// set group to "" to read the topic from the start without saving offsets
+func NewConsumer(config TopicsConfig, topic string, group string) (Consumer, error) {
+	switch config.Backend {
+	case "", KafkaBackend:
+		return NewFranzConsumer(config, topic, group)
+	case FileBackend:
+		return NewFileConsumer(config.Directory, topic, group)
+	}
+	return nil, errors.Errorf("topics backend '%s' can't be consumed", config.Backend)
+}
+
+type FranzConsumer struct {
+	client *kgo.Client
+	// transact is set when the client belongs to a transactional producer
+	// which commits the consumed offsets and closes the client
+	transact bool
+
+	mu         sync.Mutex
+	partitions map[string]topicPartition
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+func NewFranzConsumer(config TopicsConfig, topic string, group string) (*FranzConsumer, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.WithHooks(kpromMetrics),
+		kgo.ConsumeTopics(topic),
+	}
+	if group != "" {
+		opts = append(opts, kgo.ConsumerGroup(group), kgo.DisableAutoCommit())
+	} else {
+		opts = append(opts, kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()))
+	}
+	if config.Transactional {
+		opts = append(opts, kgo.FetchIsolationLevel(kgo.ReadCommitted()))
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FranzConsumer{client: client, partitions: make(map[string]topicPartition)}, nil
+}
+
+func (c *FranzConsumer) Poll(ctx context.Context) ([]ConsumedRecord, error) {
+	fetches := c.client.PollFetches(ctx)
+
+	var err error
+	fetches.EachError(func(topic string, partition int32, e error) {
+		if err == nil && e != context.Canceled && e != context.DeadlineExceeded {
+			err = errors.Wrapf(e, "failed to fetch %s/%d", topic, partition)
+		}
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]ConsumedRecord, 0)
+	fetches.EachRecord(func(r *kgo.Record) {
+		partition := fmt.Sprintf("%s/%d", r.Topic, r.Partition)
+		c.partitions[partition] = topicPartition{topic: r.Topic, partition: r.Partition}
+		var partitionKey []byte
+		for _, h := range r.Headers {
+			if h.Key == PartitionKeyHeader {
+				partitionKey = h.Value
+			}
+		}
+		out = append(out, ConsumedRecord{
+			Partition:    partition,
+			Offset:       r.Offset + 1,
+			Key:          r.Key,
+			PartitionKey: partitionKey,
+			Value:        r.Value,
+		})
+	})
+	return out, err
+}
+
+func (c *FranzConsumer) Commit(offsets map[string]int64) error {
+	if c.transact {
+		return errors.New("offsets are committed with the producer's transactions")
+	}
+	c.mu.Lock()
+	uncommitted := make(map[string]map[int32]kgo.EpochOffset)
+	for partition, offset := range offsets {
+		tp, ok := c.partitions[partition]
+		if !ok {
+			c.mu.Unlock()
+			return errors.Errorf("unknown partition %s", partition)
+		}
+		if uncommitted[tp.topic] == nil {
+			uncommitted[tp.topic] = make(map[int32]kgo.EpochOffset)
+		}
+		uncommitted[tp.topic][tp.partition] = kgo.EpochOffset{Epoch: -1, Offset: offset}
+	}
+	c.mu.Unlock()
+
+	var err error
+	c.client.CommitOffsetsSync(context.Background(), uncommitted,
+		func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, resp *kmsg.OffsetCommitResponse, e error) {
+			if e != nil {
+				err = errors.Wrap(e, "failed to commit offsets")
+				return
+			}
+			for _, t := range resp.Topics {
+				for _, p := range t.Partitions {
+					if e := kerr.ErrorForCode(p.ErrorCode); e != nil && err == nil {
+						err = errors.Wrapf(e, "failed to commit offset of %s/%d", t.Topic, p.Partition)
+					}
+				}
+			}
+		})
+	return err
+}
+
+func (c *FranzConsumer) Close() error {
+	if !c.transact {
+		c.client.Close()
+	}
+	return nil
+}
+
+// FileConsumer follows the files written for topic by every FileProducer
+// sharing a directory, including producers in other processes
+// committed offsets are saved so the next consumer in the group continues
+// where this one committed
+// each file is a partition; records read from files don't have keys
+// files written by a transactional FileProducer are only read up to the end
+// of their last commit
+type FileConsumer struct {
+	dir         string
+	topic       string
+	offsetsPath string
+	offsets     map[string]int64
+	committed   map[string]int64
+}
+
+func NewFileConsumer(dir string, topic string, group string) (*FileConsumer, error) {
+	c := &FileConsumer{
+		dir:       dir,
+		topic:     topic,
+		offsets:   make(map[string]int64),
+		committed: make(map[string]int64),
+	}
+	if group == "" {
+		return c, nil
+	}
+	c.offsetsPath = filepath.Join(dir, group+".offsets")
+
+	f, err := os.Open(c.offsetsPath)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(f).Decode(&c.committed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read offsets from %s", c.offsetsPath)
+	}
+	for path, offset := range c.committed {
+		c.offsets[path] = offset
+	}
+	return c, nil
+}
+
+func (c *FileConsumer) Poll(ctx context.Context) ([]ConsumedRecord, error) {
+	for {
+		out, err := c.read()
+		if err != nil || len(out) > 0 {
+			return out, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(filePollInterval):
+		}
+	}
+}
+
+// read returns every complete record appended since the last read
+func (c *FileConsumer) read() ([]ConsumedRecord, error) {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*", c.topic+".bin"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sort.Strings(paths)
+
+	out := make([]ConsumedRecord, 0)
+	committed := make(map[string]map[string]int64)
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if _, ok := committed[dir]; !ok {
+			committed[dir], err = readCommitted(dir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		end := int64(-1)
+		if committed[dir] != nil {
+			end = committed[dir][c.topic]
+		}
+
+		offset := c.offsets[path]
+		records, next, err := readRecordsFrom(path, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		c.offsets[path] = next
+
+		partition := filepath.Base(filepath.Dir(path))
+		for _, r := range records {
+			offset += int64(4 + len(r))
+			out = append(out, ConsumedRecord{Partition: partition, Offset: offset, Value: r})
+		}
+	}
+	return out, nil
+}
+
+// readRecordsFrom reads the complete records in a file from offset to end
+// a record which hasn't been entirely written yet is left for the next read
+// set end to -1 to read to the end of the file
+func readRecordsFrom(path string, offset int64, end int64) ([][]byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, offset, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, offset, errors.WithStack(err)
+	}
+	size := info.Size()
+	if end >= 0 && end < size {
+		size = end
+	}
+	if size <= offset {
+		return nil, offset, nil
+	}
+
+	d := make([]byte, size-offset)
+	_, err = io.ReadFull(io.NewSectionReader(f, offset, int64(len(d))), d)
+	if err != nil {
+		return nil, offset, errors.WithStack(err)
+	}
+
+	out := make([][]byte, 0)
+	for len(d) >= 4 {
+		n := int(binary.BigEndian.Uint32(d))
+		if len(d) < 4+n {
+			break
+		}
+		out = append(out, d[4:4+n])
+		d = d[4+n:]
+		offset += int64(4 + n)
+	}
+	return out, offset, nil
+}
+
+// Commit saves the offsets to the group's offsets file
+// the file is replaced atomically so a crash leaves the previous offsets
+func (c *FileConsumer) Commit(offsets map[string]int64) error {
+	if c.offsetsPath == "" {
+		return nil
+	}
+	for partition, offset := range offsets {
+		c.committed[filepath.Join(c.dir, partition, c.topic+".bin")] = offset
+	}
+
+	f, err := os.Create(c.offsetsPath + ".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = gob.NewEncoder(f).Encode(c.committed)
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	if err = f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(c.offsetsPath+".tmp", c.offsetsPath))
+}
+
+func (c *FileConsumer) Close() error {
+	return nil
+}
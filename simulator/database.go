@@ -7,6 +7,7 @@ import (
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 
 	"simulator/enum"
@@ -20,9 +21,33 @@ type Database interface {
 	Close() error
 }
 
+// ActivePackageWriter is implemented by databases which need the simulator to
+// save its active packages on shutdown; SingleStore derives them from the
+// transitions topic instead
+type ActivePackageWriter interface {
+	WriteActivePackages(simulatorID string, packages []DBActivePackage) error
+}
+
+const (
+	SingleStoreBackend  = "singlestore"
+	FileDatabaseBackend = "file"
+)
+
+// NewDatabase connects to the database selected in config
+func NewDatabase(config DatabaseConfig) (Database, error) {
+	switch config.Backend {
+	case "", SingleStoreBackend:
+		return NewSingleStore(config)
+	case FileDatabaseBackend:
+		return NewFileDatabase(config)
+	}
+	return nil, errors.Errorf("unknown database backend: '%s'", config.Backend)
+}
+
 type DBLocation struct {
 	LocationID int64
 	Kind       enum.LocationKind
+	Country    string
 	Longitude  float64
 	Latitude   float64
 	Population int
@@ -31,8 +56,15 @@ type DBLocation struct {
 type DBActivePackage struct {
 	PackageID             uuid.UUID
 	Method                enum.DeliveryMethod
+	OriginLocationID      int64
 	DestinationLocationID int64
 
+	// Returning is true once the package was returned to sender, in which case
+	// DestinationLocationID is it's origin
+	// OriginalDestinationLocationID is the destination the package was sent to
+	Returning                     bool
+	OriginalDestinationLocationID int64
+
 	// the following fields correspond to the most recent transition for this package
 	StateKind                enum.PackageState
 	TransitionSeq            int
@@ -119,10 +151,12 @@ func (s *SingleStore) Locations() ([]DBLocation, error) {
 		SELECT
 			locationid,
 			kind,
+			country,
 			geography_longitude(lonlat) AS longitude,
 			geography_latitude(lonlat) AS latitude,
 			city_population AS population
 		FROM locations
+		ORDER BY locationid
 	`)
 }
 
@@ -132,7 +166,10 @@ func (s *SingleStore) ActivePackages(simulatorID string) ([]DBActivePackage, err
 		SELECT
 			p.packageid,
 			p.method,
-			p.destination_locationid AS destinationlocationid,
+			p.origin_locationid AS originlocationid,
+			IF(r.packageid IS NULL, p.destination_locationid, p.origin_locationid) AS destinationlocationid,
+			r.packageid IS NOT NULL AS returning,
+			p.destination_locationid AS originaldestinationlocationid,
 
 			s.kind AS statekind,
 			s.seq AS transitionseq,
@@ -141,7 +178,12 @@ func (s *SingleStore) ActivePackages(simulatorID string) ([]DBActivePackage, err
 			s.recorded AS transitionrecorded
 		FROM packages p
 		INNER JOIN package_states s ON p.packageid = s.packageid
+		LEFT JOIN (
+			SELECT DISTINCT packageid FROM package_transitions
+			WHERE kind = 'returned_to_sender'
+		) r ON p.packageid = r.packageid
 		WHERE p.simulatorid = ?
+		ORDER BY p.packageid
 	`, simulatorID)
 }
 
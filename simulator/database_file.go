@@ -0,0 +1,292 @@
+package simulator
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+
+	"simulator/enum"
+)
+
+// FileDatabase loads locations directly from the simplemaps worldcities csv
+// and keeps active packages in a csv snapshot per simulator
+type FileDatabase struct {
+	locationsFile string
+	snapshotDir   string
+}
+
+var _ Database = &FileDatabase{}
+var _ ActivePackageWriter = &FileDatabase{}
+
+var snapshotHeader = []string{
+	"packageid",
+	"method",
+	"destinationlocationid",
+	"statekind",
+	"transitionseq",
+	"transitionlocationid",
+	"transitionnextlocationid",
+	"transitionrecorded",
+	"originlocationid",
+	"returning",
+	"originaldestinationlocationid",
+}
+
+func NewFileDatabase(config DatabaseConfig) (*FileDatabase, error) {
+	err := os.MkdirAll(config.SnapshotDir, 0755)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &FileDatabase{
+		locationsFile: config.LocationsFile,
+		snapshotDir:   config.SnapshotDir,
+	}, nil
+}
+
+func (f *FileDatabase) snapshotPath(simulatorID string) string {
+	return filepath.Join(f.snapshotDir, simulatorID+".csv")
+}
+
+// CurrentTime returns the most recent transition recorded in any snapshot
+func (f *FileDatabase) CurrentTime() (time.Time, error) {
+	paths, err := filepath.Glob(filepath.Join(f.snapshotDir, "*.csv"))
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+
+	var out time.Time
+	for _, path := range paths {
+		packages, err := readSnapshot(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, pkg := range packages {
+			if pkg.TransitionRecorded.After(out) {
+				out = pkg.TransitionRecorded
+			}
+		}
+	}
+
+	if out.IsZero() {
+		return time.Now(), nil
+	}
+	return out, nil
+}
+
+func (f *FileDatabase) CheckTables() error {
+	_, err := os.Stat(f.locationsFile)
+	return errors.WithStack(err)
+}
+
+// Locations applies the same rules as the locations LOAD DATA in schema.sql
+func (f *FileDatabase) Locations() ([]DBLocation, error) {
+	file, err := os.Open(f.locationsFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.ReuseRecord = true
+
+	// skip the header
+	_, err = r.Read()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	out := make([]DBLocation, 0)
+	for {
+		// city, city_ascii, lat, lng, country, iso2, iso3, admin_name, capital, population, id
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		latitude, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid latitude for location %s", record[10])
+		}
+		longitude, err := strconv.ParseFloat(record[3], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid longitude for location %s", record[10])
+		}
+		locationID, err := strconv.ParseInt(record[10], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid id for location %s", record[10])
+		}
+
+		// data is a bit messy - missing populations are treated as 0
+		var population int
+		if record[9] != "" {
+			p, err := strconv.ParseFloat(record[9], 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid population for location %s", record[10])
+			}
+			population = int(math.Round(p))
+		}
+
+		kind := enum.Point
+		if population > 1000000 {
+			kind = enum.Hub
+		}
+
+		// lets assume 0 people means 100 people
+		if population == 0 {
+			population = 100
+		}
+
+		out = append(out, DBLocation{
+			LocationID: locationID,
+			Kind:       kind,
+			Country:    record[4],
+			Longitude:  longitude,
+			Latitude:   latitude,
+			Population: population,
+		})
+	}
+
+	return out, nil
+}
+
+func (f *FileDatabase) ActivePackages(simulatorID string) ([]DBActivePackage, error) {
+	out, err := readSnapshot(f.snapshotPath(simulatorID))
+	if os.IsNotExist(errors.Cause(err)) {
+		return make([]DBActivePackage, 0), nil
+	}
+	return out, err
+}
+
+// WriteActivePackages replaces the snapshot for simulatorID
+func (f *FileDatabase) WriteActivePackages(simulatorID string, packages []DBActivePackage) error {
+	path := f.snapshotPath(simulatorID)
+
+	// write to a temporary file first so a failed write doesn't lose the previous snapshot
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	err = w.Write(snapshotHeader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, pkg := range packages {
+		err = w.Write([]string{
+			pkg.PackageID.String(),
+			string(pkg.Method),
+			strconv.FormatInt(pkg.DestinationLocationID, 10),
+			string(pkg.StateKind),
+			strconv.Itoa(pkg.TransitionSeq),
+			strconv.FormatInt(pkg.TransitionLocationID, 10),
+			strconv.FormatInt(pkg.TransitionNextLocationID, 10),
+			pkg.TransitionRecorded.Format(time.RFC3339Nano),
+			strconv.FormatInt(pkg.OriginLocationID, 10),
+			strconv.FormatBool(pkg.Returning),
+			strconv.FormatInt(pkg.OriginalDestinationLocationID, 10),
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = file.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(path+".tmp", path))
+}
+
+func (f *FileDatabase) Close() error {
+	return nil
+}
+
+func readSnapshot(path string) ([]DBActivePackage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read snapshot %s", path)
+	}
+
+	out := make([]DBActivePackage, 0, len(records))
+	for i, record := range records {
+		// skip the header
+		if i == 0 {
+			continue
+		}
+
+		pkg, err := parseSnapshotRecord(record)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid record on line %d of snapshot %s", i+1, path)
+		}
+		out = append(out, pkg)
+	}
+
+	return out, nil
+}
+
+func parseSnapshotRecord(record []string) (DBActivePackage, error) {
+	var (
+		pkg DBActivePackage
+		err error
+	)
+
+	if len(record) != len(snapshotHeader) {
+		return pkg, errors.Errorf("expected %d fields, got %d", len(snapshotHeader), len(record))
+	}
+
+	if pkg.PackageID, err = uuid.FromString(record[0]); err != nil {
+		return pkg, err
+	}
+	pkg.Method = enum.DeliveryMethod(record[1])
+	if pkg.DestinationLocationID, err = strconv.ParseInt(record[2], 10, 64); err != nil {
+		return pkg, err
+	}
+	pkg.StateKind = enum.PackageState(record[3])
+	if pkg.TransitionSeq, err = strconv.Atoi(record[4]); err != nil {
+		return pkg, err
+	}
+	if pkg.TransitionLocationID, err = strconv.ParseInt(record[5], 10, 64); err != nil {
+		return pkg, err
+	}
+	if pkg.TransitionNextLocationID, err = strconv.ParseInt(record[6], 10, 64); err != nil {
+		return pkg, err
+	}
+	if pkg.TransitionRecorded, err = time.Parse(time.RFC3339Nano, record[7]); err != nil {
+		return pkg, err
+	}
+	if pkg.OriginLocationID, err = strconv.ParseInt(record[8], 10, 64); err != nil {
+		return pkg, err
+	}
+	if pkg.Returning, err = strconv.ParseBool(record[9]); err != nil {
+		return pkg, err
+	}
+	if pkg.OriginalDestinationLocationID, err = strconv.ParseInt(record[10], 10, 64); err != nil {
+		return pkg, err
+	}
+
+	return pkg, nil
+}
@@ -0,0 +1,139 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DeadLetter is a record which couldn't be produced
+type DeadLetter struct {
+	Topic string
+	Key   RecordKey
+	Value []byte
+}
+
+// DeadLetters appends records which couldn't be produced to a file so they can
+// be replayed later
+// each dead letter is written as four fields, each prefixed by it's length as
+// a 4 byte big endian integer: topic, key, partition key and value
+type DeadLetters struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// DeadLetterPath returns the dead letter file of a producer
+func DeadLetterPath(dir string, name string) string {
+	return filepath.Join(dir, name+".bin")
+}
+
+func OpenDeadLetters(path string) (*DeadLetters, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = truncateDeadLetters(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetters{path: path}, nil
+}
+
+// truncateDeadLetters drops a dead letter which was partially written when the
+// simulator crashed, otherwise the dead letters appended after it couldn't be
+// read
+func truncateDeadLetters(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	fields, _, err := readRecordsFrom(path, 0, -1)
+	if err != nil {
+		return err
+	}
+	var end int64
+	for _, f := range fields[:len(fields)-len(fields)%4] {
+		end += int64(4 + len(f))
+	}
+	if end == info.Size() {
+		return nil
+	}
+	return errors.WithStack(os.Truncate(path, end))
+}
+
+func (d *DeadLetters) Write(l DeadLetter) error {
+	fields := [][]byte{[]byte(l.Topic), l.Key.Key, l.Key.PartitionKey, l.Value}
+	size := 0
+	for _, f := range fields {
+		size += 4 + len(f)
+	}
+	buf := make([]byte, 0, size)
+	for _, f := range fields {
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(f)))
+		buf = append(buf, header[:]...)
+		buf = append(buf, f...)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// the file is only created once a record fails
+	if d.f == nil {
+		f, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		d.f = f
+	}
+
+	// write each dead letter at once so a crash can only lose the last one
+	_, err := d.f.Write(buf)
+	return errors.WithStack(err)
+}
+
+func (d *DeadLetters) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return errors.WithStack(err)
+}
+
+// ReadDeadLetters reads every complete dead letter in a file
+func ReadDeadLetters(path string) ([]DeadLetter, error) {
+	fields, _, err := readRecordsFrom(path, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]DeadLetter, 0, len(fields)/4)
+	for ; len(fields) >= 4; fields = fields[4:] {
+		l := DeadLetter{
+			Topic: string(fields[0]),
+			Key:   RecordKey{Key: fields[1], PartitionKey: fields[2]},
+			Value: fields[3],
+		}
+		// empty keys were nil when the record was written
+		if len(l.Key.Key) == 0 {
+			l.Key.Key = nil
+		}
+		if len(l.Key.PartitionKey) == 0 {
+			l.Key.PartitionKey = nil
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
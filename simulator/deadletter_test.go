@@ -0,0 +1,50 @@
+package simulator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeadLettersTornWrite(t *testing.T) {
+	path := DeadLetterPath(filepath.Join(t.TempDir(), "dead"), "test-0")
+	write := func(letters ...DeadLetter) {
+		d, err := OpenDeadLetters(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range letters {
+			if err := d.Write(l); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := DeadLetter{Topic: "packages", Key: RecordKey{Key: []byte("a"), PartitionKey: []byte("1")}, Value: []byte("first")}
+	b := DeadLetter{Topic: "transitions", Value: []byte("second")}
+	c := DeadLetter{Topic: "packages", Key: RecordKey{Key: []byte("c")}, Value: []byte("third")}
+	write(a, b)
+
+	// a crash while writing b leaves part of it
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-int64(4+len(b.Value))-2); err != nil {
+		t.Fatal(err)
+	}
+
+	write(c)
+
+	letters, err := ReadDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprintf("%+v", letters), fmt.Sprintf("%+v", []DeadLetter{a, c}); got != want {
+		t.Fatalf("expected dead letters %s, got %s", want, got)
+	}
+}
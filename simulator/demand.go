@@ -0,0 +1,288 @@
+package simulator
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DemandModel shapes package demand over time and space
+type DemandModel interface {
+	// Demand returns the expected number of packages created at origin at time
+	// now for every package drawn from the packages_per_tick distribution
+	Demand(now time.Time, origin *Location) float64
+}
+
+type DemandConfig struct {
+	// Type is one of diurnal, weekly, seasonal or replay
+	Type string `yaml:"type"`
+
+	// Hourly contains one multiplier per local hour starting at midnight (diurnal)
+	Hourly []float64 `yaml:"hourly"`
+
+	// Weekday and Weekend are multipliers applied based on the local day (weekly)
+	Weekday float64 `yaml:"weekday"`
+	Weekend float64 `yaml:"weekend"`
+
+	// Peaks are date ranges with increased (or decreased) demand (seasonal)
+	Peaks []PeakConfig `yaml:"peaks"`
+
+	// File is a csv time series of (RFC3339 timestamp, packages) rows (replay)
+	// the series is normalized by its average so packages_per_tick still controls the scale
+	File string `yaml:"file"`
+}
+
+type PeakConfig struct {
+	// Start and End are inclusive dates formatted as MM-DD
+	// if End is before Start the peak wraps around the end of the year
+	Start      string  `yaml:"start"`
+	End        string  `yaml:"end"`
+	Multiplier float64 `yaml:"multiplier"`
+}
+
+// defaultHourlyDemand is a rough parcel intake curve with an average of 1
+var defaultHourlyDemand = []float64{
+	0.2, 0.1, 0.1, 0.1, 0.2, 0.4, 0.7, 1.0,
+	1.4, 1.6, 1.7, 1.7, 1.7, 1.7, 1.7, 1.6,
+	1.5, 1.5, 1.4, 1.2, 1.0, 0.7, 0.5, 0.3,
+}
+
+// NewDemandModel combines the configured models by multiplying their demand
+// an empty config results in a flat demand of 1
+func NewDemandModel(configs []DemandConfig) (DemandModel, error) {
+	out := make(DemandModels, 0, len(configs))
+
+	for _, c := range configs {
+		switch c.Type {
+		case "diurnal":
+			hourly := c.Hourly
+			if len(hourly) == 0 {
+				hourly = defaultHourlyDemand
+			}
+			if len(hourly) != 24 {
+				return nil, errors.Errorf("diurnal demand requires 24 hourly values, got %d", len(hourly))
+			}
+			out = append(out, DiurnalDemand{Hourly: hourly})
+
+		case "weekly":
+			out = append(out, WeeklyDemand{Weekday: c.Weekday, Weekend: c.Weekend})
+
+		case "seasonal":
+			model := SeasonalDemand{}
+			for _, p := range c.Peaks {
+				start, err := peakDay(p.Start)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid seasonal peak start '%s'", p.Start)
+				}
+				end, err := peakDay(p.End)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid seasonal peak end '%s'", p.End)
+				}
+				model.Peaks = append(model.Peaks, SeasonalPeak{
+					Start:      start,
+					End:        end,
+					Multiplier: p.Multiplier,
+				})
+			}
+			out = append(out, model)
+
+		case "replay":
+			model, err := NewReplayDemand(c.File)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, model)
+
+		default:
+			return nil, errors.Errorf("unknown demand model: '%s'", c.Type)
+		}
+	}
+
+	return out, nil
+}
+
+// peakDay returns the day of the year of a MM-DD date in a non leap year
+// time.Parse puts the date in year 0 which is a leap year, so it's YearDay is
+// one too high after February
+func peakDay(date string) (int, error) {
+	t, err := time.Parse("01-02", date)
+	if err != nil {
+		return 0, err
+	}
+	return seasonalDay(t), nil
+}
+
+// seasonalDay returns the day of the year of t's month and day in a non leap
+// year so MM-DD ranges line up on every year
+func seasonalDay(t time.Time) int {
+	return time.Date(2021, t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).YearDay()
+}
+
+// DemandModels multiplies the demand of each model
+type DemandModels []DemandModel
+
+func (d DemandModels) Demand(now time.Time, origin *Location) float64 {
+	out := 1.0
+	for _, model := range d {
+		out *= model.Demand(now, origin)
+	}
+	return out
+}
+
+// localTime approximates the local time at a location using it's longitude
+func localTime(now time.Time, loc *Location) time.Time {
+	offset := time.Duration(loc.Position[0] / 15 * float64(time.Hour))
+	return now.UTC().Add(offset)
+}
+
+// DiurnalDemand follows a daily curve in the origin's local time
+type DiurnalDemand struct {
+	Hourly []float64
+}
+
+func (d DiurnalDemand) Demand(now time.Time, origin *Location) float64 {
+	local := localTime(now, origin)
+	hour := float64(local.Hour()) + float64(local.Minute())/60
+
+	// linearly interpolate between hours so the curve doesn't have steps
+	i := int(hour)
+	frac := hour - float64(i)
+	return d.Hourly[i]*(1-frac) + d.Hourly[(i+1)%24]*frac
+}
+
+// WeeklyDemand distinguishes weekdays from weekends in the origin's local time
+type WeeklyDemand struct {
+	Weekday float64
+	Weekend float64
+}
+
+func (d WeeklyDemand) Demand(now time.Time, origin *Location) float64 {
+	switch localTime(now, origin).Weekday() {
+	case time.Saturday, time.Sunday:
+		return d.Weekend
+	default:
+		return d.Weekday
+	}
+}
+
+type SeasonalPeak struct {
+	// Start and End are days of the year (in a non leap year)
+	Start      int
+	End        int
+	Multiplier float64
+}
+
+// SeasonalDemand applies multipliers on configured dates
+type SeasonalDemand struct {
+	Peaks []SeasonalPeak
+}
+
+func (d SeasonalDemand) Demand(now time.Time, origin *Location) float64 {
+	day := seasonalDay(localTime(now, origin))
+
+	out := 1.0
+	for _, p := range d.Peaks {
+		inside := day >= p.Start && day <= p.End
+		if p.End < p.Start {
+			inside = day >= p.Start || day <= p.End
+		}
+		if inside {
+			out *= p.Multiplier
+		}
+	}
+	return out
+}
+
+// ReplayDemand follows a recorded time series
+type ReplayDemand struct {
+	Times  []time.Time
+	Values []float64
+}
+
+func NewReplayDemand(filename string) (*ReplayDemand, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	out := &ReplayDemand{}
+	total := 0.0
+
+	r := csv.NewReader(f)
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if len(record) < 2 {
+			return nil, errors.Errorf("expected a timestamp and a value on line %d of %s", line, filename)
+		}
+
+		ts, err := time.Parse(time.RFC3339, record[0])
+		if err != nil {
+			// allow a header row
+			if line == 1 {
+				continue
+			}
+			return nil, errors.Wrapf(err, "invalid timestamp on line %d of %s", line, filename)
+		}
+		value, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value on line %d of %s", line, filename)
+		}
+
+		out.Times = append(out.Times, ts)
+		out.Values = append(out.Values, value)
+		total += value
+	}
+
+	if len(out.Values) == 0 || total <= 0 {
+		return nil, errors.Errorf("replay demand file %s has no data", filename)
+	}
+	if !sort.SliceIsSorted(out.Times, func(i, j int) bool { return out.Times[i].Before(out.Times[j]) }) {
+		return nil, errors.Errorf("replay demand file %s must be sorted by time", filename)
+	}
+
+	avg := total / float64(len(out.Values))
+	for i := range out.Values {
+		out.Values[i] /= avg
+	}
+
+	return out, nil
+}
+
+// Demand returns the most recent value at or before now
+func (d *ReplayDemand) Demand(now time.Time, origin *Location) float64 {
+	i := sort.Search(len(d.Times), func(i int) bool {
+		return d.Times[i].After(now)
+	})
+	if i == 0 {
+		return d.Values[0]
+	}
+	return d.Values[i-1]
+}
+
+// stochasticRound rounds x to one of the two nearest integers such that the
+// expected value of the result is x
+func stochasticRound(r *rand.Rand, x float64) int {
+	if x <= 0 {
+		return 0
+	}
+	whole, frac := math.Modf(x)
+	if r.Float64() < frac {
+		whole++
+	}
+	return int(whole)
+}
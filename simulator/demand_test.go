@@ -0,0 +1,140 @@
+package simulator
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+func TestDemandModels(t *testing.T) {
+	greenwich := &Location{Position: orb.Point{0, 51}}
+	// 90 degrees east is 6 hours ahead
+	east := &Location{Position: orb.Point{90, 30}}
+
+	hourly := make([]float64, 24)
+	for i := range hourly {
+		hourly[i] = float64(i)
+	}
+	diurnal := DiurnalDemand{Hourly: hourly}
+	weekly := WeeklyDemand{Weekday: 1.5, Weekend: 0.5}
+	// 2021-11-25 to 2021-12-24 and a peak wrapping around new year
+	seasonal := SeasonalDemand{Peaks: []SeasonalPeak{
+		{Start: 329, End: 358, Multiplier: 2},
+		{Start: 365, End: 2, Multiplier: 3},
+	}}
+
+	// 2021-01-01 was a Friday
+	friday := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		name   string
+		model  DemandModel
+		now    time.Time
+		origin *Location
+		want   float64
+	}{
+		{"diurnal hour", diurnal, friday.Add(10 * time.Hour), greenwich, 10},
+		{"diurnal interpolated", diurnal, friday.Add(10*time.Hour + 15*time.Minute), greenwich, 10.25},
+		{"diurnal wraps at midnight", diurnal, friday.Add(23*time.Hour + 30*time.Minute), greenwich, 11.5},
+		{"diurnal local time", diurnal, friday.Add(10 * time.Hour), east, 16},
+		{"weekday", weekly, friday, greenwich, 1.5},
+		{"weekend", weekly, friday.Add(24 * time.Hour), greenwich, 0.5},
+		{"weekend in local time", weekly, friday.Add(20 * time.Hour), east, 0.5},
+		{"outside peaks", seasonal, time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), greenwich, 1},
+		{"peak start", seasonal, time.Date(2021, 11, 25, 12, 0, 0, 0, time.UTC), greenwich, 2},
+		{"peak end in a leap year", seasonal, time.Date(2020, 12, 24, 12, 0, 0, 0, time.UTC), greenwich, 2},
+		{"after peak in a leap year", seasonal, time.Date(2020, 12, 25, 12, 0, 0, 0, time.UTC), greenwich, 1},
+		{"wrapped peak", seasonal, friday.Add(12 * time.Hour), greenwich, 3},
+		{"combined", DemandModels{weekly, seasonal}, friday.Add(36 * time.Hour), greenwich, 1.5},
+		{"empty", DemandModels{}, friday, greenwich, 1},
+	} {
+		if got := c.model.Demand(c.now, c.origin); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%s: expected demand %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestNewDemandModel(t *testing.T) {
+	model, err := NewDemandModel([]DemandConfig{
+		{Type: "seasonal", Peaks: []PeakConfig{{Start: "03-01", End: "03-01", Multiplier: 2}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := &Location{Position: orb.Point{0, 0}}
+	for _, year := range []int{2020, 2021} {
+		if got := model.Demand(time.Date(year, 3, 1, 12, 0, 0, 0, time.UTC), origin); got != 2 {
+			t.Errorf("%d: expected the peak on March 1st, got demand %v", year, got)
+		}
+	}
+
+	for _, c := range []DemandConfig{
+		{Type: "diurnal", Hourly: []float64{1, 2}},
+		{Type: "seasonal", Peaks: []PeakConfig{{Start: "13-01", End: "12-01"}}},
+		{Type: "unknown"},
+	} {
+		if _, err := NewDemandModel([]DemandConfig{c}); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
+
+func TestReplayDemand(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	model, err := NewReplayDemand(write("demand.csv", "time,packages\n"+
+		"2021-01-01T00:00:00Z,10\n"+
+		"2021-01-01T01:00:00Z,30\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		now  time.Time
+		want float64
+	}{
+		{start.Add(-time.Hour), 0.5},
+		{start, 0.5},
+		{start.Add(59 * time.Minute), 0.5},
+		{start.Add(time.Hour), 1.5},
+		{start.Add(48 * time.Hour), 1.5},
+	} {
+		if got := model.Demand(c.now, nil); got != c.want {
+			t.Errorf("%s: expected demand %v, got %v", c.now, c.want, got)
+		}
+	}
+
+	for name, data := range map[string]string{
+		"empty.csv":      "time,packages\n",
+		"one-column.csv": "2021-01-01T00:00:00Z\n2021-01-01T01:00:00Z\n",
+		"value.csv":      "2021-01-01T00:00:00Z,ten\n",
+		"unsorted.csv":   "2021-01-01T01:00:00Z,1\n2021-01-01T00:00:00Z,1\n",
+		"zero.csv":       "2021-01-01T00:00:00Z,0\n",
+	} {
+		if _, err := NewReplayDemand(write(name, data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestValidateWeeklyDemand(t *testing.T) {
+	config := &Config{Demand: []DemandConfig{{Type: "weekly", Weekday: 1.1}}}
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected weekly demand without a weekend multiplier to be rejected")
+	}
+	config.Demand[0].Weekend = 0.75
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
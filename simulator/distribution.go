@@ -0,0 +1,227 @@
+package simulator
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+const (
+	ConstantType        = "constant"
+	NormalType          = "normal"
+	TruncatedNormalType = "truncated_normal"
+	LogNormalType       = "lognormal"
+	GammaType           = "gamma"
+	PoissonType         = "poisson"
+	UniformType         = "uniform"
+	EmpiricalType       = "empirical"
+)
+
+// truncatedNormalAttempts bounds the number of draws a truncated normal makes
+// before giving up and returning 0
+const truncatedNormalAttempts = 100
+
+// Sampler draws random values from a distribution
+type Sampler interface {
+	Rand() float64
+	Mean() float64
+}
+
+// DistributionConfig describes a probability distribution
+// Type selects the distribution and which of the other fields are used:
+//   - constant: always avg; a plain number in the config is a constant
+//   - normal (default): avg and stddev
+//   - truncated_normal: avg and stddev, restricted to non-negative values
+//   - lognormal, gamma: avg and stddev of the (non-negative) distribution
+//   - poisson: avg
+//   - uniform: min and max
+//   - empirical: one of values, picked with probability proportional to weights
+//     (equal weights if unset)
+type DistributionConfig struct {
+	Type    string    `yaml:"type"`
+	Avg     float64   `yaml:"avg"`
+	Stddev  float64   `yaml:"stddev"`
+	Min     float64   `yaml:"min"`
+	Max     float64   `yaml:"max"`
+	Values  []float64 `yaml:"values"`
+	Weights []float64 `yaml:"weights"`
+}
+
+// Constant returns a distribution which always returns v
+func Constant(v float64) DistributionConfig {
+	return DistributionConfig{Type: ConstantType, Avg: v}
+}
+
+func (d *DistributionConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v float64
+	if err := unmarshal(&v); err == nil {
+		*d = Constant(v)
+		return nil
+	}
+
+	// a constant from an earlier config file doesn't carry over into a distribution
+	if d.Type == ConstantType {
+		*d = DistributionConfig{}
+	}
+
+	// avoid recursing into this method
+	type plain DistributionConfig
+	return unmarshal((*plain)(d))
+}
+
+func (d *DistributionConfig) Validate() error {
+	switch d.Type {
+	case ConstantType:
+	case "", NormalType, TruncatedNormalType:
+		if d.Stddev < 0 {
+			return errors.New("stddev must not be negative")
+		}
+	case LogNormalType, GammaType:
+		if d.Avg <= 0 || d.Stddev <= 0 {
+			return errors.Errorf("%s distribution requires a positive avg and stddev", d.Type)
+		}
+	case PoissonType:
+		if d.Avg <= 0 {
+			return errors.New("poisson distribution requires a positive avg")
+		}
+	case UniformType:
+		if d.Max < d.Min {
+			return errors.New("uniform distribution requires min <= max")
+		}
+	case EmpiricalType:
+		if len(d.Values) == 0 {
+			return errors.New("empirical distribution requires values")
+		}
+		if len(d.Weights) > 0 {
+			if len(d.Weights) != len(d.Values) {
+				return errors.New("empirical distribution requires a weight per value")
+			}
+			total := 0.0
+			for _, w := range d.Weights {
+				if w < 0 {
+					return errors.New("empirical distribution weights must not be negative")
+				}
+				total += w
+			}
+			if total <= 0 {
+				return errors.New("empirical distribution requires a positive weight")
+			}
+		}
+	default:
+		return errors.Errorf("unknown distribution type: %s", d.Type)
+	}
+	return nil
+}
+
+// Mean returns the mean of the distribution without drawing from it
+func (d *DistributionConfig) Mean() float64 {
+	return d.ToDist(nil).Mean()
+}
+
+func (d *DistributionConfig) ToDist(r *rand.Rand) Sampler {
+	src := randSource{r}
+	switch d.Type {
+	case ConstantType:
+		return constant(d.Avg)
+
+	case TruncatedNormalType:
+		return &truncatedNormal{distuv.Normal{Mu: d.Avg, Sigma: d.Stddev, Src: src}}
+
+	case LogNormalType:
+		// match the mean and variance of the underlying normal distribution
+		sigma2 := math.Log(1 + (d.Stddev*d.Stddev)/(d.Avg*d.Avg))
+		return &distuv.LogNormal{
+			Mu:    math.Log(d.Avg) - sigma2/2,
+			Sigma: math.Sqrt(sigma2),
+			Src:   src,
+		}
+
+	case GammaType:
+		// shape k = avg^2/stddev^2 and rate = avg/stddev^2
+		variance := d.Stddev * d.Stddev
+		return &distuv.Gamma{
+			Alpha: d.Avg * d.Avg / variance,
+			Beta:  d.Avg / variance,
+			Src:   src,
+		}
+
+	case PoissonType:
+		return &distuv.Poisson{Lambda: d.Avg, Src: src}
+
+	case UniformType:
+		return &distuv.Uniform{Min: d.Min, Max: d.Max, Src: src}
+
+	case EmpiricalType:
+		weights := d.Weights
+		if len(weights) == 0 {
+			weights = make([]float64, len(d.Values))
+			for i := range weights {
+				weights[i] = 1
+			}
+		}
+		return &empirical{
+			values:      d.Values,
+			categorical: distuv.NewCategorical(weights, src),
+		}
+
+	default:
+		return &distuv.Normal{Mu: d.Avg, Sigma: d.Stddev, Src: src}
+	}
+}
+
+// constant doesn't consume any randomness, so a constant parameter doesn't
+// change the rest of the simulation
+type constant float64
+
+func (c constant) Rand() float64 { return float64(c) }
+func (c constant) Mean() float64 { return float64(c) }
+
+// truncatedNormal is a normal distribution restricted to non-negative values
+type truncatedNormal struct {
+	distuv.Normal
+}
+
+func (t *truncatedNormal) Rand() float64 {
+	for attempt := 0; attempt < truncatedNormalAttempts; attempt++ {
+		if x := t.Normal.Rand(); x >= 0 {
+			return x
+		}
+	}
+	return 0
+}
+
+func (t *truncatedNormal) Mean() float64 {
+	if t.Sigma == 0 {
+		return math.Max(t.Mu, 0)
+	}
+	alpha := -t.Mu / t.Sigma
+	std := distuv.UnitNormal
+	return t.Mu + t.Sigma*std.Prob(alpha)/(1-std.CDF(alpha))
+}
+
+// empirical picks one of a fixed set of values
+type empirical struct {
+	values      []float64
+	categorical distuv.Categorical
+}
+
+func (e *empirical) Rand() float64 {
+	return e.values[int(e.categorical.Rand())]
+}
+
+func (e *empirical) Mean() float64 {
+	mean := 0.0
+	for i, v := range e.values {
+		mean += v * e.categorical.Prob(float64(i))
+	}
+	return mean
+}
+
+// hoursDuration converts a number of hours into a duration
+// negative values are treated as 0 so events are never scheduled in the past
+func hoursDuration(hours float64) time.Duration {
+	return time.Duration(math.Max(hours, 0) * float64(time.Hour))
+}
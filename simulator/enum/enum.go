@@ -13,6 +13,14 @@ const (
 	ArrivalScan   TransitionKind = "arrival_scan"
 	DepartureScan TransitionKind = "departure_scan"
 	Delivered     TransitionKind = "delivered"
+
+	// exceptions
+	ExceptionDelay        TransitionKind = "exception_delay"
+	Misrouted             TransitionKind = "misrouted"
+	Damaged               TransitionKind = "damaged"
+	DeliveryAttemptFailed TransitionKind = "delivery_attempt_failed"
+	ReturnedToSender      TransitionKind = "returned_to_sender"
+	Lost                  TransitionKind = "lost"
 )
 
 type PackageState string
@@ -20,6 +28,9 @@ type PackageState string
 const (
 	AtRest    PackageState = "at_rest"
 	InTransit PackageState = "in_transit"
+
+	// Pending is only used by the simulator for packages which haven't been received yet
+	Pending PackageState = "pending"
 )
 
 type LocationKind string
@@ -29,3 +40,12 @@ const (
 	Hub   LocationKind = "hub"
 	Point LocationKind = "point"
 )
+
+type TransportMode string
+
+const (
+	Land TransportMode = "land"
+	Rail TransportMode = "rail"
+	Air  TransportMode = "air"
+	Sea  TransportMode = "sea"
+)
@@ -0,0 +1,108 @@
+package simulator
+
+import (
+	"time"
+
+	"simulator/enum"
+)
+
+// defaultCalibrationWeight is the weight of each delivered package when calibration is enabled
+const defaultCalibrationWeight = 0.05
+
+type EstimateConfig struct {
+	// CutoffHour is the hour of the day (origin local time) after which packages
+	// are treated as received on the following day; set to 0 to disable
+	CutoffHour int `yaml:"cutoff_hour"`
+
+	// ModeChangeHours is the additional handling time each time the mode of
+	// transportation changes along the route
+	ModeChangeHours float64 `yaml:"mode_change_hours"`
+
+	// Calibrate scales future estimates by how long delivered packages
+	// actually took compared to their planned transit time
+	Calibrate bool `yaml:"calibrate"`
+
+	// CalibrationWeight is the weight given to each delivered package in the
+	// moving average of actual to planned transit time (default 0.05)
+	CalibrationWeight float64 `yaml:"calibration_weight"`
+}
+
+// Estimator calculates delivery estimates from a package's planned route
+type Estimator struct {
+	config EstimateConfig
+
+	// Calibration scales the planned transit time of each delivery method
+	Calibration map[enum.DeliveryMethod]float64
+}
+
+func NewEstimator(config EstimateConfig) *Estimator {
+	if config.CalibrationWeight == 0 {
+		config.CalibrationWeight = defaultCalibrationWeight
+	}
+	return &Estimator{
+		config:      config,
+		Calibration: make(map[enum.DeliveryMethod]float64),
+	}
+}
+
+// PlannedTransit returns the time it should take to move a package along it's route
+// the planned route already includes the average time at rest and the time
+// spent waiting for scheduled vehicles at each hop
+func (e *Estimator) PlannedTransit(received time.Time, route []PlannedHop) time.Duration {
+	if len(route) == 0 {
+		return 0
+	}
+
+	transit := route[len(route)-1].PlannedArrival.Sub(received)
+
+	modeChanges := 0
+	for i := 1; i+1 < len(route); i++ {
+		if route[i].Mode != route[i-1].Mode {
+			modeChanges++
+		}
+	}
+	transit += time.Duration(float64(modeChanges) * e.config.ModeChangeHours * float64(time.Hour))
+
+	return transit
+}
+
+// Estimate returns when a package received at origin with the given planned
+// transit time is expected to be delivered
+func (e *Estimator) Estimate(received time.Time, origin *Location, method enum.DeliveryMethod, transit time.Duration) time.Time {
+	start := received
+	if e.config.CutoffHour > 0 {
+		local := localTime(received, origin)
+		if local.Hour() >= e.config.CutoffHour {
+			// the package is processed starting the next day
+			midnight := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, time.UTC)
+			start = received.Add(midnight.Sub(local))
+		}
+	}
+
+	if factor, ok := e.Calibration[method]; ok {
+		transit = time.Duration(float64(transit) * factor)
+	}
+
+	return start.Add(transit)
+}
+
+// Observe records a delivered package
+func (e *Estimator) Observe(t *Tracker, delivered time.Time) {
+	if t.PlannedTransit <= 0 || t.Returning {
+		return
+	}
+
+	deliveryEstimateError.Observe(delivered.Sub(t.DeliveryEstimate).Hours())
+
+	if !e.config.Calibrate {
+		return
+	}
+
+	ratio := float64(delivered.Sub(t.Received)) / float64(t.PlannedTransit)
+	factor, ok := e.Calibration[t.Method]
+	if !ok {
+		factor = 1
+	}
+	w := e.config.CalibrationWeight
+	e.Calibration[t.Method] = (1-w)*factor + w*ratio
+}
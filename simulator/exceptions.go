@@ -0,0 +1,216 @@
+package simulator
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"simulator/enum"
+)
+
+type ExceptionsConfig struct {
+	// each probability is a distribution which is sampled once per simulated day
+	// so exception rates can vary from day to day; a plain number is constant
+
+	// Delay is the probability that a package is held at a location it arrives at
+	Delay      DistributionConfig `yaml:"delay"`
+	DelayHours DistributionConfig `yaml:"delay_hours"`
+
+	// Damaged is the probability that a package is damaged at a location it
+	// arrives at; damaged packages are held for repackaging before continuing
+	Damaged      DistributionConfig `yaml:"damaged"`
+	DamagedHours DistributionConfig `yaml:"damaged_hours"`
+
+	// Misrouted is the probability that a package departs to the wrong location
+	// it's rerouted from wherever it ends up
+	Misrouted DistributionConfig `yaml:"misrouted"`
+
+	// Lost is the probability that a package never arrives at it's next location
+	Lost DistributionConfig `yaml:"lost"`
+
+	// DeliveryAttemptFailed is the probability that a delivery attempt fails
+	// failed deliveries are retried the next day
+	DeliveryAttemptFailed DistributionConfig `yaml:"delivery_attempt_failed"`
+
+	// MaxDeliveryAttempts is the number of failed attempts after which a
+	// package is returned to sender (0 = unlimited)
+	MaxDeliveryAttempts int `yaml:"max_delivery_attempts"`
+}
+
+// ExceptionRates are the probabilities of each exception on the current simulated day
+type ExceptionRates struct {
+	Day time.Time
+
+	Delay                 float64
+	Damaged               float64
+	Misrouted             float64
+	Lost                  float64
+	DeliveryAttemptFailed float64
+}
+
+type exceptionSamplers struct {
+	delay                 Sampler
+	damaged               Sampler
+	misrouted             Sampler
+	lost                  Sampler
+	deliveryAttemptFailed Sampler
+}
+
+func newExceptionSamplers(c ExceptionsConfig, r *rand.Rand) exceptionSamplers {
+	return exceptionSamplers{
+		delay:                 c.Delay.ToDist(r),
+		damaged:               c.Damaged.ToDist(r),
+		misrouted:             c.Misrouted.ToDist(r),
+		lost:                  c.Lost.ToDist(r),
+		deliveryAttemptFailed: c.DeliveryAttemptFailed.ToDist(r),
+	}
+}
+
+// probability clamps a sampled probability to [0, 1]
+func probability(s Sampler) float64 {
+	return math.Min(math.Max(s.Rand(), 0), 1)
+}
+
+// updateExceptionRates draws new exception rates at the start of each simulated day
+func (s *State) updateExceptionRates(now time.Time) {
+	day := now.Truncate(24 * time.Hour)
+	if day.Equal(s.ExceptionRates.Day) {
+		return
+	}
+
+	s.ExceptionRates = ExceptionRates{
+		Day:                   day,
+		Delay:                 probability(s.exceptionSamplers.delay),
+		Damaged:               probability(s.exceptionSamplers.damaged),
+		Misrouted:             probability(s.exceptionSamplers.misrouted),
+		Lost:                  probability(s.exceptionSamplers.lost),
+		DeliveryAttemptFailed: probability(s.exceptionSamplers.deliveryAttemptFailed),
+	}
+}
+
+// chance returns true with probability p
+// no randomness is consumed when p is 0 so disabled exceptions don't change the simulation
+func (s *State) chance(p float64) bool {
+	return p > 0 && s.Rand.Float64() < p
+}
+
+// Misroute occasionally replaces the next location with a wrong neighbor
+func Misroute(state *State, t *Tracker, current *Location, next *Location) *Location {
+	if !state.chance(state.ExceptionRates.Misrouted) {
+		return next
+	}
+
+	candidates := make([]*Location, 0, len(current.Nearest))
+	for _, loc := range current.Nearest {
+		if loc != next {
+			candidates = append(candidates, loc)
+		}
+	}
+	if len(candidates) == 0 {
+		return next
+	}
+
+	t.Misrouted = true
+	return candidates[state.Rand.Intn(len(candidates))]
+}
+
+// TriggerArrivalExceptions runs after an arrival scan at an interim location
+func TriggerArrivalExceptions(state *State, t *Tracker) {
+	if t.Misrouted {
+		t.Misrouted = false
+		triggerException(state, t, enum.Misrouted, 0)
+	}
+
+	if state.chance(state.ExceptionRates.Damaged) {
+		triggerException(state, t, enum.Damaged, hoursDuration(state.DamagedHours.Rand()))
+	}
+
+	if state.chance(state.ExceptionRates.Delay) {
+		triggerException(state, t, enum.ExceptionDelay, hoursDuration(state.DelayHours.Rand()))
+	}
+}
+
+// triggerException records an exception at the tracker's current location and
+// holds the package for an additional delay
+func triggerException(state *State, t *Tracker, kind enum.TransitionKind, delay time.Duration) {
+	t.Seq = t.Seq + 1
+	t.NextTransitionTime = t.NextTransitionTime.Add(delay)
+
+	if state.Verbose >= VerboseDebug {
+		log.Printf("Exception(%s): %s; delayed %s",
+			t.PackageID.String()[:8],
+			kind,
+			delay)
+	}
+
+	err := state.Topics.WriteTransition(state.Clock.Now(), kind, t)
+	if err != nil {
+		log.Panicf("failed to write transition to topic: %v", err)
+	}
+}
+
+// TriggerLost records that the package disappeared while travelling to it's next location
+func TriggerLost(state *State, t *Tracker) {
+	t.Seq = t.Seq + 1
+
+	if state.Verbose >= VerboseDebug {
+		log.Printf("Lost(%s)", t.PackageID.String()[:8])
+	}
+
+	err := state.Topics.WriteTransition(state.Clock.Now(), enum.Lost, t)
+	if err != nil {
+		log.Panicf("failed to write transition to topic: %v", err)
+	}
+}
+
+// TriggerDeliveryAttemptFailed records a failed delivery attempt
+// after MaxDeliveryAttempts the package is returned to sender
+func TriggerDeliveryAttemptFailed(state *State, t *Tracker) {
+	now := state.Clock.Now()
+
+	t.State = enum.InTransit
+	t.Seq = t.Seq + 1
+	t.LastLocationID = t.NextLocationID
+	t.LastTransitionTime = now
+	t.DeliveryAttempts++
+
+	// the tracker stays in transit to the destination so the next transition is another attempt
+	t.NextTransitionTime = now.Add(24 * time.Hour)
+
+	if state.Verbose >= VerboseDebug {
+		log.Printf("DeliveryAttemptFailed(%s): attempt %d", t.PackageID.String()[:8], t.DeliveryAttempts)
+	}
+
+	err := state.Topics.WriteTransition(now, enum.DeliveryAttemptFailed, t)
+	if err != nil {
+		log.Panicf("failed to write transition to topic: %v", err)
+	}
+
+	if state.Exceptions.MaxDeliveryAttempts > 0 && t.DeliveryAttempts >= state.Exceptions.MaxDeliveryAttempts {
+		TriggerReturnedToSender(state, t)
+	}
+}
+
+// TriggerReturnedToSender records that the package won't be delivered and
+// routes it back to it's origin
+func TriggerReturnedToSender(state *State, t *Tracker) {
+	now := state.Clock.Now()
+
+	t.State = enum.AtRest
+	t.Seq = t.Seq + 1
+
+	if state.Verbose >= VerboseDebug {
+		log.Printf("ReturnedToSender(%s)", t.PackageID.String()[:8])
+	}
+
+	err := state.Topics.WriteTransition(now, enum.ReturnedToSender, t)
+	if err != nil {
+		log.Panicf("failed to write transition to topic: %v", err)
+	}
+
+	t.DestinationLocationID = t.OriginLocationID
+	t.Returning = true
+	t.OffRoute = true
+	t.NextTransitionTime = now
+}
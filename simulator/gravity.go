@@ -0,0 +1,204 @@
+package simulator
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/quadtree"
+	"github.com/pkg/errors"
+)
+
+// gravityAttempts bounds the number of candidates considered per destination
+const gravityAttempts = 1000
+
+// gravityNearKM is the radius within which destinations are weighted exactly
+// rather than by rejection sampling
+const gravityNearKM = 500
+
+var ErrNoDestination = errors.New("unable to find a destination")
+
+type GravityConfig struct {
+	// Beta is the distance decay exponent: P(dest | origin) ∝ pop_origin * pop_dest / distance^beta
+	// set to 0 to ignore distance
+	Beta float64 `yaml:"beta"`
+
+	// DomesticRatio is the probability that a package stays within the origin's country
+	// leave unset to ignore countries
+	DomesticRatio *float64 `yaml:"domestic_ratio"`
+
+	// CountryDomesticRatio overrides DomesticRatio for specific origin countries
+	CountryDomesticRatio map[string]float64 `yaml:"country_domestic_ratio"`
+}
+
+func (c GravityConfig) Enabled() bool {
+	return c.Beta > 0 || c.DomesticRatio != nil || len(c.CountryDomesticRatio) > 0
+}
+
+// GravityModel picks destinations based on population, distance and country
+type GravityModel struct {
+	config    GravityConfig
+	qt        *quadtree.Quadtree
+	all       *locationSampler
+	countries map[string]*locationSampler
+}
+
+func NewGravityModel(config GravityConfig, idx *LocationIndex) *GravityModel {
+	byCountry := make(map[string][]*Location)
+	for _, loc := range idx.popSorted {
+		byCountry[loc.Country] = append(byCountry[loc.Country], loc)
+	}
+
+	countries := make(map[string]*locationSampler, len(byCountry))
+	for country, locations := range byCountry {
+		countries[country] = newLocationSampler(locations)
+	}
+
+	return &GravityModel{
+		config:    config,
+		qt:        idx.qt,
+		all:       idx.sampler,
+		countries: countries,
+	}
+}
+
+func (g *GravityModel) domesticRatio(origin *Location) (float64, bool) {
+	if ratio, ok := g.config.CountryDomesticRatio[origin.Country]; ok {
+		return ratio, true
+	}
+	if g.config.DomesticRatio != nil {
+		return *g.config.DomesticRatio, true
+	}
+	return 0, false
+}
+
+// Destination picks a destination for a package received at origin which is
+// at least minDistanceKM away
+func (g *GravityModel) Destination(r *rand.Rand, origin *Location, minDistanceKM float64) (*Location, error) {
+	ratio, useCountries := g.domesticRatio(origin)
+
+	if useCountries && r.Float64() < ratio {
+		domestic := func(candidate *Location) bool {
+			return candidate.Country == origin.Country
+		}
+		if dest, ok := g.sample(r, g.countries[origin.Country], origin, minDistanceKM, domestic); ok {
+			return dest, nil
+		}
+		// the origin country may be too small for minDistanceKM; ship internationally instead
+	}
+
+	if useCountries {
+		international := func(candidate *Location) bool {
+			return candidate.Country != origin.Country
+		}
+		if dest, ok := g.sample(r, g.all, origin, minDistanceKM, international); ok {
+			return dest, nil
+		}
+	}
+
+	if dest, ok := g.sample(r, g.all, origin, minDistanceKM, nil); ok {
+		return dest, nil
+	}
+
+	return nil, ErrNoDestination
+}
+
+// sample draws a destination with probability proportional to
+// pop_dest / distance^beta from the candidates in s more than minDistanceKM away
+// candidates within gravityNearKM get exact weights; farther ones are drawn by
+// population and accepted with probability (radius / distance)^beta which is
+// at most 1 beyond the radius, so the result is exact however small
+// minDistanceKM is
+func (g *GravityModel) sample(r *rand.Rand, s *locationSampler, origin *Location, minDistanceKM float64, filter func(*Location) bool) (*Location, bool) {
+	radius := minDistanceKM
+	if g.config.Beta > 0 {
+		radius = math.Max(radius, gravityNearKM)
+	}
+
+	eligible := func(candidate *Location) bool {
+		return candidate != origin && (filter == nil || filter(candidate))
+	}
+	near := g.near(origin, radius, minDistanceKM, eligible)
+	farWeight := float64(s.cumulative[len(s.cumulative)-1]) * math.Pow(radius, -g.config.Beta)
+
+	for attempt := 0; attempt < gravityAttempts; attempt++ {
+		if near.total > 0 && r.Float64()*(near.total+farWeight) < near.total {
+			return near.Rand(r), true
+		}
+
+		candidate := s.Rand(r)
+		if !eligible(candidate) {
+			continue
+		}
+
+		// candidates within the radius are drawn from near
+		distance := geo.Distance(origin.Position, candidate.Position) / 1000
+		if distance <= radius {
+			continue
+		}
+
+		if g.config.Beta > 0 && r.Float64() >= math.Pow(radius/distance, g.config.Beta) {
+			continue
+		}
+
+		return candidate, true
+	}
+
+	return nil, false
+}
+
+// weightedLocations draws locations with probability proportional to their weight
+type weightedLocations struct {
+	locations  []*Location
+	cumulative []float64
+	total      float64
+}
+
+func (w *weightedLocations) Rand(r *rand.Rand) *Location {
+	x := r.Float64() * w.total
+	i := sort.Search(len(w.cumulative), func(i int) bool {
+		return w.cumulative[i] > x
+	})
+	if i == len(w.cumulative) {
+		i--
+	}
+	return w.locations[i]
+}
+
+// near weights the eligible locations more than minDistanceKM and at most
+// radius away from origin by pop_dest / distance^beta
+func (g *GravityModel) near(origin *Location, radius float64, minDistanceKM float64, eligible func(*Location) bool) *weightedLocations {
+	out := &weightedLocations{}
+	if radius <= minDistanceKM {
+		return out
+	}
+
+	bound := geo.NewBoundAroundPoint(origin.Position, radius*1000)
+	bounds := []orb.Bound{bound}
+	// the bound wraps around the antimeridian
+	if bound.Min[0] > bound.Max[0] {
+		bounds = []orb.Bound{
+			{Min: bound.Min, Max: orb.Point{180, bound.Max[1]}},
+			{Min: orb.Point{-180, bound.Min[1]}, Max: bound.Max},
+		}
+	}
+
+	for _, b := range bounds {
+		for _, p := range g.qt.InBound(nil, b) {
+			candidate := p.(*Location)
+			if !eligible(candidate) {
+				continue
+			}
+			distance := geo.Distance(origin.Position, candidate.Position) / 1000
+			if distance <= minDistanceKM || distance > radius {
+				continue
+			}
+			out.total += float64(candidate.Population) * math.Pow(distance, -g.config.Beta)
+			out.locations = append(out.locations, candidate)
+			out.cumulative = append(out.cumulative, out.total)
+		}
+	}
+	return out
+}
@@ -0,0 +1,149 @@
+package simulator
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/paulmach/orb/geo"
+
+	"simulator/enum"
+)
+
+func gravityTestIndex(t *testing.T) *LocationIndex {
+	t.Helper()
+
+	locations := make([]DBLocation, 0)
+	id := int64(1)
+	for lng := -20.0; lng <= 40; lng += 2.5 {
+		for lat := 30.0; lat <= 60; lat += 2.5 {
+			country := "West"
+			if lng >= 10 {
+				country = "East"
+			}
+			locations = append(locations, DBLocation{
+				LocationID: id,
+				Kind:       enum.Point,
+				Country:    country,
+				Longitude:  lng,
+				Latitude:   lat,
+				Population: int(id%17+1) * 10000,
+			})
+			id++
+		}
+	}
+
+	index, err := NewLocationIndexFromDB(locations, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestGravityDestinationDistance(t *testing.T) {
+	const samples = 100000
+	index := gravityTestIndex(t)
+	origin, err := index.Lookup(150)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// destinations are bucketed by distance
+	bucket := func(dest *Location) int {
+		return int(geo.Distance(origin.Position, dest.Position) / 1000 / 250)
+	}
+
+	for _, c := range []struct {
+		name          string
+		beta          float64
+		minDistanceKM float64
+	}{
+		{"no minimum distance", 2, 0},
+		{"minimum distance", 1.5, 1000},
+		{"minimum distance within the near radius", 3, 300},
+		{"distance ignored", 0, 500},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			expected := make(map[int]float64)
+			total := 0.0
+			for _, dest := range index.popSorted {
+				distance := geo.Distance(origin.Position, dest.Position) / 1000
+				if dest == origin || distance <= c.minDistanceKM {
+					continue
+				}
+				w := float64(dest.Population) * math.Pow(distance, -c.beta)
+				expected[bucket(dest)] += w
+				total += w
+			}
+
+			g := NewGravityModel(GravityConfig{Beta: c.beta}, index)
+			r := rand.New(rand.NewSource(1))
+			observed := make(map[int]float64)
+			for i := 0; i < samples; i++ {
+				dest, err := g.Destination(r, origin, c.minDistanceKM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if geo.Distance(origin.Position, dest.Position)/1000 <= c.minDistanceKM {
+					t.Fatalf("destination %d is closer than %vkm", dest.LocationID, c.minDistanceKM)
+				}
+				observed[bucket(dest)]++
+			}
+
+			for b, w := range expected {
+				p := w / total
+				got := observed[b] / samples
+				// 5 standard deviations of the observed proportion
+				if tolerance := 5 * math.Sqrt(p*(1-p)/samples); math.Abs(got-p) > tolerance {
+					t.Errorf("%d-%dkm: expected %.4f of destinations, got %.4f", b*250, (b+1)*250, p, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGravityDomesticRatio(t *testing.T) {
+	const samples = 20000
+	index := gravityTestIndex(t)
+	origin, err := index.Lookup(150)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ratio := 0.7
+	g := NewGravityModel(GravityConfig{Beta: 1, DomesticRatio: &ratio}, index)
+	r := rand.New(rand.NewSource(1))
+	domestic := 0
+	for i := 0; i < samples; i++ {
+		dest, err := g.Destination(r, origin, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dest.Country == origin.Country {
+			domestic++
+		}
+	}
+	if got := float64(domestic) / samples; math.Abs(got-ratio) > 0.02 {
+		t.Errorf("expected %.2f of destinations to be domestic, got %.2f", ratio, got)
+	}
+
+	// no domestic destination is far enough away from the eastern edge so
+	// packages ship internationally
+	east, err := index.Lookup(319)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		dest, err := g.Destination(r, east, 3500)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dest.Country == east.Country || geo.Distance(east.Position, dest.Position)/1000 <= 3500 {
+			t.Fatalf("unexpected destination %d in %s", dest.LocationID, dest.Country)
+		}
+	}
+
+	if _, err := g.Destination(r, origin, 20000); err != ErrNoDestination {
+		t.Fatalf("expected ErrNoDestination, got %v", err)
+	}
+}
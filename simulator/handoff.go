@@ -0,0 +1,363 @@
+package simulator
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"simulator/enum"
+)
+
+// HandoffTopic carries packages between the simulators of a partitioned world
+const HandoffTopic = "handoffs"
+
+// handoffCommitInterval is how often ConsumeHandoffs commits the offsets of
+// handoffs which were saved in a checkpoint
+const handoffCommitInterval = time.Second
+
+// handoffPollInterval is how often a worker consuming it's own handoffs
+// checks for new ones
+const handoffPollInterval = 100 * time.Millisecond
+
+// Handoff passes a package to the simulator responsible for Region
+// it contains everything needed to continue tracking the package
+type Handoff struct {
+	Region string
+
+	PackageID                     uuid.UUID
+	ParentPackageID               uuid.UUID
+	Method                        enum.DeliveryMethod
+	OriginLocationID              int64
+	DestinationLocationID         int64
+	OriginalDestinationLocationID int64
+	Returning                     bool
+
+	State            enum.PackageState
+	Seq              int
+	LastLocationID   int64
+	NextLocationID   int64
+	Mode             enum.TransportMode
+	Misrouted        bool
+	DeliveryAttempts int
+
+	LastTransitionTime time.Time
+	NextTransitionTime time.Time
+
+	Route    []PlannedHop
+	Hop      int
+	OffRoute bool
+
+	Received         time.Time
+	PlannedTransit   time.Duration
+	DeliveryEstimate time.Time
+}
+
+func NewHandoff(region string, t *Tracker) *Handoff {
+	return &Handoff{
+		Region: region,
+
+		PackageID:                     t.PackageID,
+		ParentPackageID:               t.ParentPackageID,
+		Method:                        t.Method,
+		OriginLocationID:              t.OriginLocationID,
+		DestinationLocationID:         t.DestinationLocationID,
+		OriginalDestinationLocationID: t.OriginalDestinationLocationID,
+		Returning:                     t.Returning,
+
+		State:            t.State,
+		Seq:              t.Seq,
+		LastLocationID:   t.LastLocationID,
+		NextLocationID:   t.NextLocationID,
+		Mode:             t.Mode,
+		Misrouted:        t.Misrouted,
+		DeliveryAttempts: t.DeliveryAttempts,
+
+		LastTransitionTime: t.LastTransitionTime,
+		NextTransitionTime: t.NextTransitionTime,
+
+		Route:    t.Route,
+		Hop:      t.Hop,
+		OffRoute: t.OffRoute,
+
+		Received:         t.Received,
+		PlannedTransit:   t.PlannedTransit,
+		DeliveryEstimate: t.DeliveryEstimate,
+	}
+}
+
+// Tracker resumes tracking the handed off package
+func (h *Handoff) Tracker() *Tracker {
+	return &Tracker{
+		PackageID:                     h.PackageID,
+		ParentPackageID:               h.ParentPackageID,
+		Method:                        h.Method,
+		OriginLocationID:              h.OriginLocationID,
+		DestinationLocationID:         h.DestinationLocationID,
+		OriginalDestinationLocationID: h.OriginalDestinationLocationID,
+		Returning:                     h.Returning,
+
+		State:            h.State,
+		Seq:              h.Seq,
+		LastLocationID:   h.LastLocationID,
+		NextLocationID:   h.NextLocationID,
+		Mode:             h.Mode,
+		Misrouted:        h.Misrouted,
+		DeliveryAttempts: h.DeliveryAttempts,
+
+		LastTransitionTime: h.LastTransitionTime,
+		NextTransitionTime: h.NextTransitionTime,
+
+		Route:    h.Route,
+		Hop:      h.Hop,
+		OffRoute: h.OffRoute,
+
+		Received:         h.Received,
+		PlannedTransit:   h.PlannedTransit,
+		DeliveryEstimate: h.DeliveryEstimate,
+	}
+}
+
+// trackerLocationID returns the location the tracker is at or travelling to
+func trackerLocationID(t *Tracker) int64 {
+	switch t.State {
+	case enum.InTransit:
+		return t.NextLocationID
+	case enum.Pending:
+		return t.OriginLocationID
+	default:
+		return t.LastLocationID
+	}
+}
+
+// HandOff writes the tracker to the handoff topic if the location it's at or
+// travelling to belongs to another region
+// returns false if this simulator should keep tracking the package
+func HandOff(state *State, t *Tracker) bool {
+	if state.Partition == nil {
+		return false
+	}
+	locationID := trackerLocationID(t)
+	if state.Partition.Owns(locationID) {
+		return false
+	}
+
+	region := state.Partition.Owner(locationID)
+	err := state.Topics.WriteHandoff(NewHandoff(region, t))
+	if err != nil {
+		log.Panicf("failed to write handoff to topic: %v", err)
+	}
+	handoffsSent.Inc()
+
+	if state.Verbose >= VerboseDebug {
+		log.Printf("HandOff(%s): to region %s", t.PackageID.String()[:8], region)
+	}
+	return true
+}
+
+// AcceptHandoffs starts tracking every package handed off to this simulator
+// which is waiting for a worker
+func AcceptHandoffs(state *State) {
+	if state.HandoffConsumer != nil {
+		pollHandoffs(state)
+	}
+	for {
+		select {
+		case t := <-state.Handoffs:
+			AcceptHandoff(state, t)
+		default:
+			return
+		}
+	}
+}
+
+// AcceptHandoff starts tracking a package handed off to this simulator
+// the handoff's offset is committed once the worker's next checkpoint is saved
+func AcceptHandoff(state *State, t *Tracker) {
+	if t.handoff != nil {
+		state.handoffs = append(state.handoffs, t.handoff)
+		t.handoff = nil
+	}
+	state.Trackers.PushTracker(t)
+	handoffsReceived.Inc()
+
+	// the regions' clocks aren't synchronized, so a package whose next
+	// transition is already due is processed late at our current time
+	skew := state.Clock.Now().Sub(t.NextTransitionTime)
+	handoffSkew.Observe(skew.Hours())
+	if skew > 0 {
+		handoffsLate.Inc()
+	}
+}
+
+// pollHandoffs accepts the handoffs read by the worker's own consumer
+// their offsets are committed in the worker's next transaction, which
+// contains the checkpoint the packages are saved in
+func pollHandoffs(state *State) {
+	now := time.Now()
+	if now.Before(state.nextHandoffPoll) {
+		return
+	}
+	state.nextHandoffPoll = now.Add(handoffPollInterval)
+
+	// a canceled context only returns the records which were already fetched
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	records, err := state.HandoffConsumer.Poll(ctx)
+	if err != nil {
+		log.Printf("failed to read handoffs: %+v", err)
+	}
+	for _, r := range records {
+		if t := decodeHandoff(state.Topics.schemaIDs, state.Partition.Region, r); t != nil {
+			AcceptHandoff(state, t)
+		}
+	}
+}
+
+// decodeHandoff returns the tracker of a package handed off to region or nil
+// if the record is for another region or can't be decoded
+func decodeHandoff(schemaIDs map[string]int, region string, r ConsumedRecord) *Tracker {
+	var h Handoff
+	err := decodeRecord(schemaIDs, HandoffTopic, r.Value, &h)
+	if err != nil {
+		log.Printf("failed to decode handoff: %+v", err)
+		return nil
+	}
+	if h.Region != region {
+		return nil
+	}
+	return h.Tracker()
+}
+
+// HandoffOffsets tracks the consumed handoffs which aren't saved in a
+// checkpoint yet, so the consumer's offsets never move past a package which
+// would be lost in a crash
+type HandoffOffsets struct {
+	mu      sync.Mutex
+	pending map[string][]*handoffOffset
+}
+
+// handoffOffset is the offset of a consumed handoff
+// saved is set once the package is in a checkpoint
+type handoffOffset struct {
+	offsets   *HandoffOffsets
+	partition string
+	offset    int64
+	saved     bool
+}
+
+func NewHandoffOffsets() *HandoffOffsets {
+	return &HandoffOffsets{pending: make(map[string][]*handoffOffset)}
+}
+
+func (o *HandoffOffsets) add(r ConsumedRecord, saved bool) *handoffOffset {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h := &handoffOffset{offsets: o, partition: r.Partition, offset: r.Offset, saved: saved}
+	o.pending[r.Partition] = append(o.pending[r.Partition], h)
+	return h
+}
+
+// saveHandoffs marks the handoffs as saved in a checkpoint
+func saveHandoffs(handoffs []*handoffOffset) {
+	for _, h := range handoffs {
+		h.offsets.mu.Lock()
+		h.saved = true
+		h.offsets.mu.Unlock()
+	}
+}
+
+// SaveAll marks every consumed handoff as saved
+// only call it once every package is saved, e.g. on shutdown
+func (o *HandoffOffsets) SaveAll() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, pending := range o.pending {
+		for _, h := range pending {
+			h.saved = true
+		}
+	}
+}
+
+// Committable returns the offset of each partition up to which every handoff
+// is saved and forgets those handoffs
+func (o *HandoffOffsets) Committable() map[string]int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	out := make(map[string]int64)
+	for partition, pending := range o.pending {
+		i := 0
+		for ; i < len(pending) && pending[i].saved; i++ {
+			out[partition] = pending[i].offset
+		}
+		o.pending[partition] = pending[i:]
+	}
+	return out
+}
+
+// CommitHandoffs commits the offsets of every handoff saved so far
+func CommitHandoffs(consumer Consumer, offsets *HandoffOffsets) error {
+	committable := offsets.Committable()
+	if len(committable) == 0 {
+		return nil
+	}
+	return consumer.Commit(committable)
+}
+
+// ConsumeHandoffs reads packages handed off to the world's region and sends
+// them to the workers on ch until closeCh is closed
+// packages which were read but not sent are returned so they can be saved
+// the offsets of handoffs are committed once the package is in a checkpoint
+func ConsumeHandoffs(consumer Consumer, offsets *HandoffOffsets, world *World, ch chan<- *Tracker, closeCh <-chan struct{}) []*Tracker {
+	region := world.Partition.Region
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-closeCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	unsent := make([]*Tracker, 0)
+	for {
+		err := CommitHandoffs(consumer, offsets)
+		if err != nil {
+			log.Printf("failed to commit handoffs: %+v", err)
+		}
+
+		pollCtx, pollCancel := context.WithTimeout(ctx, handoffCommitInterval)
+		records, err := consumer.Poll(pollCtx)
+		pollCancel()
+		if err != nil && pollCtx.Err() == nil {
+			log.Printf("failed to read handoffs: %+v", err)
+		}
+
+		for _, r := range records {
+			t := decodeHandoff(world.SchemaIDs, region, r)
+			if t == nil {
+				offsets.add(r, true)
+				continue
+			}
+			t.handoff = offsets.add(r, false)
+			if ctx.Err() != nil {
+				unsent = append(unsent, t)
+				continue
+			}
+			select {
+			case ch <- t:
+			case <-ctx.Done():
+				unsent = append(unsent, t)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return unsent
+		}
+	}
+}
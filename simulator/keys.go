@@ -0,0 +1,82 @@
+package simulator
+
+import (
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// partitioners select the partition key of each record
+const (
+	// PackagePartitioner keeps each package's records in the partition picked
+	// by hashing it's id
+	PackagePartitioner = "package"
+
+	// RegionPartitioner keeps the records of packages with the same
+	// destination region in a single partition
+	RegionPartitioner = "region"
+
+	// SimulatorPartitioner keeps every record written by a simulator in a
+	// single partition
+	SimulatorPartitioner = "simulator"
+)
+
+func validatePartitioner(name string) error {
+	switch name {
+	case "", PackagePartitioner, RegionPartitioner, SimulatorPartitioner:
+		return nil
+	}
+	return errors.Errorf("unknown partitioner '%s'", name)
+}
+
+// RecordKeys picks the key and partition key of every record
+// records are keyed by the package (or shipment) they describe so consumers
+// can check the records of each package arrive in order
+type RecordKeys struct {
+	partitioner string
+	simulatorID string
+	locations   *LocationIndex
+	partition   *Partition
+}
+
+func NewRecordKeys(partitioner string, simulatorID string, world *World) *RecordKeys {
+	if partitioner == "" {
+		partitioner = PackagePartitioner
+	}
+	return &RecordKeys{
+		partitioner: partitioner,
+		simulatorID: simulatorID,
+		locations:   world.Locations,
+		partition:   world.Partition,
+	}
+}
+
+// Key returns the key of a record about id travelling to destinationID
+// destinationID must not change during a package's lifetime (even when it's
+// returned to sender) or it's records could be split between partitions
+func (k *RecordKeys) Key(id uuid.UUID, destinationID int64) RecordKey {
+	key := RecordKey{Key: []byte(id.String())}
+
+	switch k.partitioner {
+	case SimulatorPartitioner:
+		key.PartitionKey = []byte(k.simulatorID)
+	case RegionPartitioner:
+		key.PartitionKey = []byte(k.region(destinationID))
+	}
+	return key
+}
+
+// region returns the region of a location or it's country when the world
+// isn't partitioned
+func (k *RecordKeys) region(locationID int64) string {
+	if k.partition != nil {
+		return k.partition.Owner(locationID)
+	}
+	if k.locations == nil {
+		return ""
+	}
+	loc, err := k.locations.Lookup(locationID)
+	if err != nil {
+		return ""
+	}
+	return loc.Country
+}
@@ -23,8 +23,10 @@ var (
 type Location struct {
 	LocationID  int64
 	Kind        enum.LocationKind
+	Country     string
 	Position    orb.Point
 	Population  int
+	Capacity    float64
 	Nearest     []*Location
 	NearestHubs []*Location
 }
@@ -38,11 +40,39 @@ func NewLocationFromDB(dbloc DBLocation) *Location {
 	return &Location{
 		LocationID: dbloc.LocationID,
 		Kind:       dbloc.Kind,
+		Country:    dbloc.Country,
 		Position:   orb.Point{dbloc.Longitude, dbloc.Latitude},
 		Population: dbloc.Population,
 	}
 }
 
+// locationSampler draws locations with probability proportional to their population
+type locationSampler struct {
+	locations  []*Location
+	cumulative []int64
+}
+
+func newLocationSampler(locations []*Location) *locationSampler {
+	s := &locationSampler{
+		locations:  locations,
+		cumulative: make([]int64, len(locations)),
+	}
+	var total int64
+	for i, loc := range locations {
+		total += int64(loc.Population)
+		s.cumulative[i] = total
+	}
+	return s
+}
+
+func (s *locationSampler) Rand(r *rand.Rand) *Location {
+	x := r.Int63n(s.cumulative[len(s.cumulative)-1])
+	i := sort.Search(len(s.cumulative), func(i int) bool {
+		return s.cumulative[i] > x
+	})
+	return s.locations[i]
+}
+
 type LocationQueueItem struct {
 	loc                   *Location
 	score                 float64
@@ -91,12 +121,16 @@ func (l *LocationQueue) PopLocation() (*Location, float64) {
 	return item.loc, item.distanceToDestination
 }
 
+// randAttempts bounds the number of samples LocationIndex.Rand draws looking for a match
+const randAttempts = 1000
+
+var ErrNoCandidate = errors.New("no location matched the filter")
+
 type LocationIndex struct {
-	qt            *quadtree.Quadtree
-	ht            map[int64]*Location
-	popSorted     []*Location
-	minPopulation int
-	maxPopulation int
+	qt        *quadtree.Quadtree
+	ht        map[int64]*Location
+	popSorted []*Location
+	sampler   *locationSampler
 
 	debugLogging bool
 }
@@ -119,11 +153,14 @@ func NewLocationIndexFromDB(dblocs []DBLocation, debugLogging bool) (*LocationIn
 	}
 
 	// popSorted must be sorted by population
+	// ties are broken by id so the order doesn't depend on the order of dblocs
 	sort.Slice(idx.popSorted, func(i, j int) bool {
+		if idx.popSorted[i].Population == idx.popSorted[j].Population {
+			return idx.popSorted[i].LocationID < idx.popSorted[j].LocationID
+		}
 		return idx.popSorted[i].Population < idx.popSorted[j].Population
 	})
-	idx.minPopulation = idx.popSorted[0].Population
-	idx.maxPopulation = idx.popSorted[len(idx.popSorted)-1].Population
+	idx.sampler = newLocationSampler(idx.popSorted)
 
 	const (
 		Pi      = math.Pi
@@ -326,28 +363,17 @@ func (idx *LocationIndex) Lookup(locationID int64) (*Location, error) {
 	return nil, errors.Errorf("location %d not found", locationID)
 }
 
-func randBetween(min int, max int) int {
-	return rand.Intn(max-min+1) + min
-}
-
 // Rand returns a random location in the index for which the filter returns true
+// locations are picked with probability proportional to their population
 // filter can be nil which implies no filter
-func (idx *LocationIndex) Rand(filter quadtree.FilterFunc) *Location {
-	randPopulation := randBetween(idx.minPopulation, idx.maxPopulation)
-
-	i := sort.Search(len(idx.popSorted), func(i int) bool {
-		return idx.popSorted[i].Population >= randPopulation
-	})
-
-	attempts := 10
-	for attempt := 0; attempt < attempts; attempt++ {
-		candidate := idx.popSorted[i]
+// returns ErrNoCandidate if no match is found after a bounded number of samples
+func (idx *LocationIndex) Rand(r *rand.Rand, filter quadtree.FilterFunc) (*Location, error) {
+	for attempt := 0; attempt < randAttempts; attempt++ {
+		candidate := idx.sampler.Rand(r)
 		if filter == nil || filter(candidate) {
-			return candidate
+			return candidate, nil
 		}
-		i = (i + 1) % len(idx.popSorted)
 	}
 
-	log.Fatalf("failed to find candidate in %d attempts", attempts)
-	return nil
+	return nil, errors.WithStack(ErrNoCandidate)
 }
@@ -0,0 +1,83 @@
+package simulator
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/pkg/errors"
+
+	"simulator/enum"
+)
+
+func TestLocationSampler(t *testing.T) {
+	const samples = 100000
+	populations := []int{0, 1000, 5000, 10000, 84000}
+	locations := make([]*Location, len(populations))
+	for i, pop := range populations {
+		locations[i] = &Location{LocationID: int64(i), Population: pop}
+	}
+	s := newLocationSampler(locations)
+
+	counts := make(map[int64]int)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < samples; i++ {
+		counts[s.Rand(r).LocationID]++
+	}
+
+	for i, pop := range populations {
+		p := float64(pop) / 100000
+		got := float64(counts[int64(i)]) / samples
+		if pop == 0 && counts[int64(i)] > 0 {
+			t.Errorf("location %d without population was sampled %d times", i, counts[int64(i)])
+		}
+		// 5 standard deviations of the observed proportion
+		if tolerance := 5 * math.Sqrt(p*(1-p)/samples); math.Abs(got-p) > tolerance {
+			t.Errorf("location %d: expected %.4f of samples, got %.4f", i, p, got)
+		}
+	}
+
+	// the same seed draws the same locations
+	a, b := rand.New(rand.NewSource(2)), rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		if x, y := s.Rand(a), s.Rand(b); x != y {
+			t.Fatalf("draw %d: expected the same location, got %d and %d", i, x.LocationID, y.LocationID)
+		}
+	}
+}
+
+func TestLocationIndexRand(t *testing.T) {
+	dblocs := make([]DBLocation, 0)
+	for i := int64(1); i <= 20; i++ {
+		dblocs = append(dblocs, DBLocation{
+			LocationID: i,
+			Kind:       enum.Point,
+			Longitude:  float64(i),
+			Latitude:   float64(i),
+			Population: int(i) * 1000,
+		})
+	}
+	index, err := NewLocationIndexFromDB(dblocs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		loc, err := index.Rand(r, func(p orb.Pointer) bool {
+			return p.(*Location).LocationID%5 == 0
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc.LocationID%5 != 0 {
+			t.Fatalf("location %d doesn't match the filter", loc.LocationID)
+		}
+	}
+
+	_, err = index.Rand(r, func(p orb.Pointer) bool { return false })
+	if errors.Cause(err) != ErrNoCandidate {
+		t.Fatalf("expected ErrNoCandidate, got %v", err)
+	}
+}
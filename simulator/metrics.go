@@ -5,9 +5,71 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var (
+	routeDeviations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "simulator_route_deviations_total",
+		Help: "The number of packages which deviated from their planned route",
+	})
+
+	routeArrivalDelay = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "simulator_route_arrival_delay_hours",
+		Help:    "Actual minus planned arrival time at each hop of a planned route",
+		Buckets: []float64{-24, -6, -1, 0, 1, 6, 24, 72, 168},
+	})
+
+	deliveryEstimateError = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "simulator_delivery_estimate_error_hours",
+		Help:    "Actual minus estimated delivery time of delivered packages",
+		Buckets: []float64{-72, -24, -6, -1, 0, 1, 6, 24, 72},
+	})
+
+	packagesSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "simulator_packages_skipped_total",
+		Help: "The number of packages which weren't created because no destination was found",
+	})
+
+	handoffsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "simulator_handoffs_sent_total",
+		Help: "The number of packages handed off to another region",
+	})
+
+	handoffsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "simulator_handoffs_received_total",
+		Help: "The number of packages handed off from another region",
+	})
+
+	handoffsLate = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "simulator_handoffs_late_total",
+		Help: "The number of handed off packages whose next transition was due before they were received",
+	})
+
+	handoffSkew = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "simulator_handoff_skew_hours",
+		Help:    "Time a handed off package was received minus the time of it's next transition",
+		Buckets: []float64{-24, -6, -1, 0, 1, 6, 24, 72, 168},
+	})
+
+	produceErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "simulator_produce_errors_total",
+		Help: "The number of records which couldn't be produced after retrying",
+	}, []string{"topic"})
+
+	deadLetters = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "simulator_dead_letters_total",
+		Help: "The number of failed records written to the dead letter directory",
+	})
+
+	produceBlocked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "simulator_produce_blocked_seconds_total",
+		Help: "Time spent waiting for room in the producer's buffer",
+	})
+)
+
 func ExportMetrics(config MetricsConfig) {
 	log.Printf("serving /metrics on port %d", config.Port)
 	http.Handle("/metrics", promhttp.Handler())
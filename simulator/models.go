@@ -16,6 +16,17 @@ type Package struct {
 	DestinationLocationID int64
 	DeliveryEstimate      time.Time
 	Method                enum.DeliveryMethod
+
+	// ParentPackageID is set on returns and refers to the package being returned
+	ParentPackageID *uuid.UUID
+}
+
+type RouteHop struct {
+	PackageID        uuid.UUID
+	Hop              int
+	LocationID       int64
+	PlannedArrival   time.Time
+	PlannedDeparture *time.Time
 }
 
 type Transition struct {
@@ -25,4 +36,7 @@ type Transition struct {
 	NextLocationID int64
 	Recorded       time.Time
 	Kind           enum.TransitionKind
+
+	// Mode is only set on departure scans
+	Mode *enum.TransportMode
 }
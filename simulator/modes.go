@@ -0,0 +1,167 @@
+package simulator
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"simulator/enum"
+)
+
+type ModeConfig struct {
+	// Speed is the speed (km/h) of the mode; a new speed is drawn for each leg
+	// routes are planned using the mean speed
+	Speed DistributionConfig `yaml:"speed_kmph"`
+
+	// CostPerKM is the relative cost of moving a package one km
+	// standard packages travel on the cheapest eligible mode
+	CostPerKM float64 `yaml:"cost_per_km"`
+
+	// MinDistanceKM and MaxDistanceKM bound the length of a leg (0 = unbounded)
+	MinDistanceKM float64 `yaml:"min_distance_km"`
+	MaxDistanceKM float64 `yaml:"max_distance_km"`
+
+	// Kinds restricts the mode to legs between these kinds of locations
+	// leave empty to allow any location
+	Kinds []enum.LocationKind `yaml:"kinds"`
+
+	// Interval is the time between scheduled departures on each lane
+	// only used when shipments are enabled
+	Interval time.Duration `yaml:"interval"`
+
+	// Capacity is the maximum number of packages per vehicle (0 = unlimited)
+	// only used when shipments are enabled
+	// every worker runs it's own vehicles, so a lane carries up to
+	// workers * capacity packages per departure
+	Capacity int `yaml:"capacity"`
+}
+
+// TransportModel is a configured mode of transportation
+type TransportModel struct {
+	ModeConfig
+	Mode enum.TransportMode
+
+	// SpeedKMPH is the mean speed of the mode
+	SpeedKMPH float64
+}
+
+// NewTransportModels returns the configured modes sorted by name
+// when no modes are configured, land and air are derived from the legacy
+// min_air_freight_distance_km and avg_*_speed_kmph settings
+// the legacy shipments.vehicles settings fill in the interval and capacity of
+// modes which don't set them
+func NewTransportModels(c *Config) ([]*TransportModel, error) {
+	modes := c.Modes
+	if len(modes) == 0 {
+		modes = map[enum.TransportMode]ModeConfig{
+			enum.Land: {
+				Speed:         Constant(c.AvgLandSpeedKMPH),
+				CostPerKM:     1,
+				MaxDistanceKM: c.MinAirFreightDistanceKM,
+			},
+			enum.Air: {
+				Speed:         Constant(c.AvgAirSpeedKMPH),
+				CostPerKM:     2,
+				MinDistanceKM: c.MinAirFreightDistanceKM,
+			},
+		}
+	}
+
+	for mode := range c.Shipments.Vehicles {
+		if _, ok := modes[mode]; !ok {
+			return nil, errors.Errorf("shipments.vehicles.%s: transport mode %s isn't configured in modes", mode, mode)
+		}
+	}
+
+	out := make([]*TransportModel, 0, len(modes))
+	for mode, config := range modes {
+		if v, ok := c.Shipments.Vehicles[mode]; ok {
+			if config.Interval == 0 {
+				config.Interval = v.Interval
+			}
+			if config.Capacity == 0 {
+				config.Capacity = v.Capacity
+			}
+		}
+
+		switch mode {
+		case enum.Land, enum.Rail, enum.Air, enum.Sea:
+		default:
+			return nil, errors.Errorf("unknown transport mode: %s", mode)
+		}
+		if err := config.Speed.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "transport mode %s: speed_kmph", mode)
+		}
+		speed := config.Speed.Mean()
+		if speed <= 0 {
+			return nil, errors.Errorf("transport mode %s: speed_kmph must be positive", mode)
+		}
+		if config.MaxDistanceKM > 0 && config.MaxDistanceKM < config.MinDistanceKM {
+			return nil, errors.Errorf("transport mode %s: max_distance_km is less than min_distance_km", mode)
+		}
+		out = append(out, &TransportModel{ModeConfig: config, Mode: mode, SpeedKMPH: speed})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Mode < out[j].Mode
+	})
+
+	return out, nil
+}
+
+// Eligible returns true if the mode can carry a package distanceKM between from and to
+func (m *TransportModel) Eligible(from *Location, to *Location, distanceKM float64) bool {
+	if distanceKM < m.MinDistanceKM {
+		return false
+	}
+	if m.MaxDistanceKM > 0 && distanceKM > m.MaxDistanceKM {
+		return false
+	}
+	return m.allowsKind(from.Kind) && m.allowsKind(to.Kind)
+}
+
+func (m *TransportModel) allowsKind(kind enum.LocationKind) bool {
+	if len(m.Kinds) == 0 {
+		return true
+	}
+	for _, k := range m.Kinds {
+		if k == enum.Any || k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// better returns true if a is preferred over b for the given method
+// express packages take the fastest mode, standard packages the cheapest
+func better(a *TransportModel, b *TransportModel, method enum.DeliveryMethod) bool {
+	if method == enum.Express {
+		return a.SpeedKMPH > b.SpeedKMPH
+	}
+	if a.CostPerKM == b.CostPerKM {
+		return a.SpeedKMPH > b.SpeedKMPH
+	}
+	return a.CostPerKM < b.CostPerKM
+}
+
+// SelectMode picks the mode used for a leg
+func SelectMode(modes []*TransportModel, from *Location, to *Location, distanceKM float64, method enum.DeliveryMethod) *TransportModel {
+	var selected *TransportModel
+	for _, m := range modes {
+		if m.Eligible(from, to, distanceKM) && (selected == nil || better(m, selected, method)) {
+			selected = m
+		}
+	}
+	if selected != nil {
+		return selected
+	}
+
+	// no mode serves this leg, so ignore the restrictions rather than strand the package
+	for _, m := range modes {
+		if selected == nil || better(m, selected, method) {
+			selected = m
+		}
+	}
+	return selected
+}
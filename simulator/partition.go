@@ -0,0 +1,243 @@
+package simulator
+
+import (
+	"math/rand"
+	"strconv"
+
+	"github.com/paulmach/orb"
+	"github.com/pkg/errors"
+)
+
+// maxQuadtreeDepth bounds how many times the world is split when partitioning by quadtree
+const maxQuadtreeDepth = 16
+
+type RegionConfig struct {
+	Name string `yaml:"name"`
+
+	// Countries lists the countries in the region
+	Countries []string `yaml:"countries"`
+
+	// Bounds is [min longitude, min latitude, max longitude, max latitude]
+	Bounds []float64 `yaml:"bounds"`
+}
+
+type PartitionConfig struct {
+	// Region is the region simulated by this process
+	// leave empty to simulate every location
+	Region string `yaml:"region"`
+
+	// Quadtree splits the world into this many regions of similar population
+	// named 0, 1, ... which follow the cells of a quadtree
+	Quadtree int `yaml:"quadtree"`
+
+	// Regions lists the regions explicitly; each location belongs to the first
+	// region matching it's country or bounds
+	// a region without countries or bounds matches every remaining location
+	Regions []RegionConfig `yaml:"regions"`
+
+	// HandoffBuffer is the number of handed off packages which may be waiting
+	// for a worker (default 1024)
+	HandoffBuffer int `yaml:"handoff_buffer"`
+}
+
+func (c PartitionConfig) Enabled() bool {
+	return c.Region != ""
+}
+
+// Partition assigns every location to a region
+// this simulator only tracks packages while they are at or travelling to a
+// location in it's own region
+type Partition struct {
+	Region  string
+	Regions []string
+
+	owners map[int64]string
+
+	// sampler picks origins from the locations in Region
+	sampler *locationSampler
+}
+
+func NewPartition(config PartitionConfig, idx *LocationIndex) (*Partition, error) {
+	p := &Partition{
+		Region: config.Region,
+		owners: make(map[int64]string, len(idx.popSorted)),
+	}
+
+	switch {
+	case config.Quadtree > 0 && len(config.Regions) > 0:
+		return nil, errors.New("partition: quadtree and regions are mutually exclusive")
+	case config.Quadtree > 0:
+		p.splitQuadtree(idx, config.Quadtree)
+	case len(config.Regions) > 0:
+		err := p.assignRegions(idx, config.Regions)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("partition: either quadtree or regions is required")
+	}
+
+	owned := make([]*Location, 0)
+	for _, loc := range idx.popSorted {
+		if p.owners[loc.LocationID] == p.Region {
+			owned = append(owned, loc)
+		}
+	}
+	if len(owned) == 0 {
+		return nil, errors.Errorf("partition: region %s has no locations", p.Region)
+	}
+	p.sampler = newLocationSampler(owned)
+
+	return p, nil
+}
+
+func (p *Partition) assignRegions(idx *LocationIndex, regions []RegionConfig) error {
+	type matcher struct {
+		name      string
+		countries map[string]struct{}
+		bound     *orb.Bound
+	}
+
+	matchers := make([]matcher, 0, len(regions))
+	seen := make(map[string]struct{})
+	for _, r := range regions {
+		if r.Name == "" {
+			return errors.New("partition: every region needs a name")
+		}
+		if _, ok := seen[r.Name]; ok {
+			return errors.Errorf("partition: region %s is listed twice", r.Name)
+		}
+		seen[r.Name] = empty
+		p.Regions = append(p.Regions, r.Name)
+
+		m := matcher{name: r.Name, countries: make(map[string]struct{})}
+		for _, country := range r.Countries {
+			m.countries[country] = empty
+		}
+		if len(r.Bounds) > 0 {
+			if len(r.Bounds) != 4 {
+				return errors.Errorf("partition: bounds of region %s must be [min longitude, min latitude, max longitude, max latitude]", r.Name)
+			}
+			m.bound = &orb.Bound{
+				Min: orb.Point{r.Bounds[0], r.Bounds[1]},
+				Max: orb.Point{r.Bounds[2], r.Bounds[3]},
+			}
+		}
+		matchers = append(matchers, m)
+	}
+	if _, ok := seen[p.Region]; !ok {
+		return errors.Errorf("partition: region %s is not listed", p.Region)
+	}
+
+	unowned := 0
+	for _, loc := range idx.popSorted {
+		for _, m := range matchers {
+			_, inCountry := m.countries[loc.Country]
+			inBound := m.bound != nil && m.bound.Contains(loc.Position)
+			catchAll := len(m.countries) == 0 && m.bound == nil
+			if inCountry || inBound || catchAll {
+				p.owners[loc.LocationID] = m.name
+				break
+			}
+		}
+		if _, ok := p.owners[loc.LocationID]; !ok {
+			unowned++
+		}
+	}
+	if unowned > 0 {
+		return errors.Errorf("partition: %d locations don't belong to any region", unowned)
+	}
+	return nil
+}
+
+type quadtreeCell struct {
+	bound      orb.Bound
+	locations  []*Location
+	population int64
+}
+
+// splitQuadtree recursively splits the world into quadrants until no cell has
+// more than a small fraction of the population, then groups consecutive cells
+// into n regions of similar population
+// the cells are visited in z-order so each region is geographically compact
+func (p *Partition) splitQuadtree(idx *LocationIndex, n int) {
+	var total int64
+	for _, loc := range idx.popSorted {
+		total += int64(loc.Population)
+	}
+	limit := total / int64(8*n)
+
+	cells := make([]quadtreeCell, 0)
+	var split func(c quadtreeCell, depth int)
+	split = func(c quadtreeCell, depth int) {
+		if c.population <= limit || len(c.locations) <= 1 || depth >= maxQuadtreeDepth {
+			cells = append(cells, c)
+			return
+		}
+
+		center := c.bound.Center()
+		quadrants := [4]quadtreeCell{
+			{bound: orb.Bound{Min: c.bound.Min, Max: center}},
+			{bound: orb.Bound{Min: orb.Point{center[0], c.bound.Min[1]}, Max: orb.Point{c.bound.Max[0], center[1]}}},
+			{bound: orb.Bound{Min: orb.Point{c.bound.Min[0], center[1]}, Max: orb.Point{center[0], c.bound.Max[1]}}},
+			{bound: orb.Bound{Min: center, Max: c.bound.Max}},
+		}
+		for _, loc := range c.locations {
+			q := 0
+			if loc.Position[0] >= center[0] {
+				q++
+			}
+			if loc.Position[1] >= center[1] {
+				q += 2
+			}
+			quadrants[q].locations = append(quadrants[q].locations, loc)
+			quadrants[q].population += int64(loc.Population)
+		}
+		for _, q := range quadrants {
+			if len(q.locations) > 0 {
+				split(q, depth+1)
+			}
+		}
+	}
+	split(quadtreeCell{
+		bound:      orb.Bound{Min: minGeoPoint, Max: maxGeoPoint},
+		locations:  idx.popSorted,
+		population: total,
+	}, 0)
+
+	for i := 0; i < n; i++ {
+		p.Regions = append(p.Regions, strconv.Itoa(i))
+	}
+
+	// each cell joins the region containing the middle of it's share of the population
+	var cumulative int64
+	for _, c := range cells {
+		region := n - 1
+		if total > 0 {
+			middle := float64(cumulative) + float64(c.population)/2
+			if r := int(middle / float64(total) * float64(n)); r < n {
+				region = r
+			}
+		}
+		for _, loc := range c.locations {
+			p.owners[loc.LocationID] = p.Regions[region]
+		}
+		cumulative += c.population
+	}
+}
+
+// Owner returns the region containing the location
+func (p *Partition) Owner(locationID int64) string {
+	return p.owners[locationID]
+}
+
+// Owns returns true if the location is in this simulator's region
+func (p *Partition) Owns(locationID int64) bool {
+	return p.owners[locationID] == p.Region
+}
+
+// Rand returns a random location in this simulator's region
+// locations are picked with probability proportional to their population
+func (p *Partition) Rand(r *rand.Rand) *Location {
+	return p.sampler.Rand(r)
+}
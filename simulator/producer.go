@@ -2,11 +2,12 @@ package simulator
 
 import (
 	"context"
-	"io"
 	"log"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,26 +16,214 @@ import (
 )
 
 type Producer interface {
-	TopicWriter(topic string) io.Writer
+	TopicWriter(topic string) RecordWriter
+	// Flush blocks until every record written so far has been persisted
+	Flush() error
 	Close() error
 }
 
+// TransactionalProducer produces records in transactions, each ending with a
+// marker written to CheckpointTopic
+type TransactionalProducer interface {
+	Producer
+
+	// Transactional returns false if records are produced without transactions
+	Transactional() bool
+
+	// Commit writes marker keyed by the producer's name and atomically
+	// produces it along with every record written since the last commit
+	// it takes ownership of marker and returns ErrTransactionAborted if the
+	// transaction was aborted without an error
+	Commit(marker *RecordBuffer) error
+
+	// LastCommit returns the marker of the last committed transaction or nil
+	// if the producer hasn't committed anything yet
+	LastCommit() ([]byte, error)
+}
+
+// ErrTransactionAborted is returned by Commit when the transaction was aborted
+// because partitions the producer consumed from were reassigned; the records
+// consumed since the last commit will be consumed again
+var ErrTransactionAborted = errors.New("transaction aborted by a rebalance")
+
+// PartitionKeyHeader overrides the key used to pick a record's partition
+const PartitionKeyHeader = "partition_key"
+
+// RecordKey identifies the stream a record belongs to
+// records with the same partition key (or key, if the partition key is nil)
+// are written to the same partition in the order they were written
+type RecordKey struct {
+	Key          []byte
+	PartitionKey []byte
+}
+
+// RecordWriter writes records to a single topic
+type RecordWriter interface {
+	// WriteRecord takes ownership of b, the caller mustn't use it afterwards
+	// the writer releases b once it no longer needs it's bytes, even when
+	// returning an error
+	WriteRecord(key RecordKey, b *RecordBuffer) error
+}
+
+// maxPooledRecordSize stops rare large records from growing every pooled buffer
+const maxPooledRecordSize = 64 * 1024
+
+var recordBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &RecordBuffer{B: make([]byte, 0, 256)}
+	},
+}
+
+// RecordBuffer holds the bytes of a single record
+// buffers are pooled so producing a record doesn't allocate
+type RecordBuffer struct {
+	B []byte
+}
+
+// NewRecordBuffer returns an empty buffer from the pool
+func NewRecordBuffer() *RecordBuffer {
+	return recordBufferPool.Get().(*RecordBuffer)
+}
+
+func (b *RecordBuffer) Write(d []byte) (int, error) {
+	b.B = append(b.B, d...)
+	return len(d), nil
+}
+
+// Release returns the buffer to the pool
+// neither the buffer nor it's bytes may be used afterwards
+func (b *RecordBuffer) Release() {
+	if cap(b.B) > maxPooledRecordSize {
+		return
+	}
+	b.B = b.B[:0]
+	recordBufferPool.Put(b)
+}
+
+const (
+	KafkaBackend  = "kafka"
+	FileBackend   = "file"
+	MemoryBackend = "memory"
+)
+
+// NewProducer creates a Producer for the backend selected in config
+// name must be unique per producer, the file backend uses it to separate output
+func NewProducer(config TopicsConfig, name string) (Producer, error) {
+	switch config.Backend {
+	case "", KafkaBackend:
+		p, err := NewFranzProducer(config, name)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case FileBackend:
+		return NewFileProducer(filepath.Join(config.Directory, name), config.Transactional)
+	case MemoryBackend:
+		return NewMemoryProducer(), nil
+	}
+	return nil, errors.Errorf("unknown topics backend: '%s'", config.Backend)
+}
+
+// defaultMaxBufferedRecords is used when max_buffered_records isn't configured
+const defaultMaxBufferedRecords = 100000
+
+// producerClient is the part of the kgo.Client used by a FranzProducer
+type producerClient interface {
+	Produce(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error))
+	Flush(ctx context.Context) error
+	BeginTransaction() error
+	AbortBufferedRecords(ctx context.Context) error
+	EndTransaction(ctx context.Context, commit kgo.TransactionEndTry) error
+	Close()
+}
+
 type FranzProducer struct {
-	client        *kgo.Client
+	config        TopicsConfig
+	name          string
+	transactional bool
+	client        producerClient
 	closed        int32 // nonzero if the producer has started closing. accessed via atomics
 	pendingWrites sync.WaitGroup
+
+	// closeMu is held to check closed and add to pendingWrites as one step so
+	// Close can't start waiting between them
+	closeMu sync.RWMutex
+
+	// session is set when the producer consumes in it's transactions
+	session *kgo.GroupTransactSession
+
+	// deadLetters is nil when failed records are dropped
+	deadLetters *DeadLetters
+	failFast    bool
+
+	mu  sync.Mutex
+	err error // the first record which failed when failing fast or in the current transaction
 }
 
 var (
 	kpromMetrics = kprom.NewMetrics("franzgo", kprom.Registry(prometheus.DefaultRegisterer.(*prometheus.Registry)))
 )
 
-func NewFranzProducer(config TopicsConfig) (Producer, error) {
+// NewFranzProducer creates a producer writing to kafka
+// name must be unique per producer, it's used to name the dead letter file
+func NewFranzProducer(config TopicsConfig, name string) (*FranzProducer, error) {
+	return newFranzProducer(config, name, nil)
+}
+
+// NewTransactProducer creates a transactional producer which also consumes
+// topic as a member of group
+// the offsets of the records it consumed are committed with each transaction
+// and a transaction is aborted when the producer's partitions are reassigned
+func NewTransactProducer(config TopicsConfig, name string, topic string, group string) (*FranzProducer, Consumer, error) {
+	if !config.Transactional {
+		return nil, nil, errors.New("transactional topics required")
+	}
+	p, err := newFranzProducer(config, name, []kgo.Opt{
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumerGroup(group),
+		kgo.DisableAutoCommit(),
+		kgo.FetchIsolationLevel(kgo.ReadCommitted()),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, &FranzConsumer{client: p.session.Client(), transact: true, partitions: make(map[string]topicPartition)}, nil
+}
+
+// ConsumesInTransactions returns true if consumers can commit their offsets
+// in a producer's transactions, which only the kafka backend supports
+func (c TopicsConfig) ConsumesInTransactions() bool {
+	return c.Transactional && (c.Backend == "" || c.Backend == KafkaBackend)
+}
+
+// newFranzProducer creates a producer which consumes in a transact session
+// when consumeOpts are given
+func newFranzProducer(config TopicsConfig, name string, consumeOpts []kgo.Opt) (*FranzProducer, error) {
+	maxBuffered := config.MaxBufferedRecords
+	if maxBuffered == 0 {
+		maxBuffered = defaultMaxBufferedRecords
+	}
+
 	opts := []kgo.Opt{
 		kgo.SeedBrokers(config.Brokers...),
 		kgo.WithHooks(kpromMetrics),
-		kgo.MaxBufferedRecords(1e7),
+		kgo.MaxBufferedRecords(maxBuffered),
 		kgo.BatchMaxBytes(int32(config.BatchMaxBytes)),
+		kgo.RecordPartitioner(partitionKeyPartitioner{}),
+	}
+	if config.ProduceRetries > 0 {
+		opts = append(opts, kgo.ProduceRetries(config.ProduceRetries))
+	}
+	if config.RecordTimeout > 0 {
+		opts = append(opts, kgo.RecordTimeout(config.RecordTimeout))
+	}
+	if config.Transactional {
+		// producers resuming from a checkpoint reuse the id which fences the
+		// previous producer and aborts it's open transaction
+		opts = append(opts, kgo.TransactionalID(name))
+		if config.TransactionTimeout > 0 {
+			opts = append(opts, kgo.TransactionTimeout(config.TransactionTimeout))
+		}
 	}
 
 	if config.Compression {
@@ -43,17 +232,52 @@ func NewFranzProducer(config TopicsConfig) (Producer, error) {
 		opts = append(opts, kgo.BatchCompression(kgo.NoCompression()))
 	}
 
-	client, err := kgo.NewClient(opts...)
-	if err != nil {
-		return nil, err
+	var (
+		client  *kgo.Client
+		session *kgo.GroupTransactSession
+		err     error
+	)
+	if consumeOpts != nil {
+		session, err = kgo.NewGroupTransactSession(append(opts, consumeOpts...)...)
+		if err != nil {
+			return nil, err
+		}
+		client = session.Client()
+	} else {
+		client, err = kgo.NewClient(opts...)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return &FranzProducer{
-		client: client,
-	}, nil
+	p := &FranzProducer{
+		config:        config,
+		name:          name,
+		transactional: config.Transactional,
+		client:        client,
+		session:       session,
+		failFast:      config.FailFast,
+	}
+	if p.transactional {
+		err = client.BeginTransaction()
+		if err != nil {
+			client.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+	// a transaction with a failed record is aborted rather than keeping the
+	// record for later
+	if config.DeadLetterDir != "" && !p.transactional {
+		p.deadLetters, err = OpenDeadLetters(DeadLetterPath(config.DeadLetterDir, name))
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return p, nil
 }
 
-func (p *FranzProducer) TopicWriter(topic string) io.Writer {
+func (p *FranzProducer) TopicWriter(topic string) RecordWriter {
 	if p.Closed() {
 		panic("closed")
 	}
@@ -64,39 +288,254 @@ func (p *FranzProducer) Closed() bool {
 	return atomic.LoadInt32(&p.closed) != 0
 }
 
+// Err returns the error of the first record which failed when failing fast
+func (p *FranzProducer) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Flush blocks until every record written so far has been produced or failed
+// it returns an error if a record failed and the producer is failing fast
+func (p *FranzProducer) Flush() error {
+	err := p.client.Flush(context.Background())
+	if err != nil {
+		return err
+	}
+	return p.Err()
+}
+
+// fail handles a record which couldn't be produced
+func (p *FranzProducer) fail(topic string, key RecordKey, d []byte, err error) {
+	produceErrors.WithLabelValues(topic).Inc()
+	log.Printf("FranzProducer error on topic %s: %+v", topic, err)
+
+	if p.deadLetters != nil {
+		dlErr := p.deadLetters.Write(DeadLetter{Topic: topic, Key: key, Value: d})
+		if dlErr != nil {
+			log.Printf("FranzProducer failed to write dead letter: %+v", dlErr)
+		} else {
+			deadLetters.Inc()
+		}
+	}
+
+	if p.failFast || p.transactional {
+		p.mu.Lock()
+		if p.err == nil {
+			p.err = errors.Wrapf(err, "failed to produce record to %s", topic)
+		}
+		p.mu.Unlock()
+	}
+}
+
 func (p *FranzProducer) Close() error {
+	p.closeMu.Lock()
 	if p.Closed() {
+		p.closeMu.Unlock()
 		return errors.New("already closed")
 	}
 	atomic.StoreInt32(&p.closed, 1)
+	p.closeMu.Unlock()
 
 	p.pendingWrites.Wait()
 
+	if p.transactional {
+		// records written since the last commit are discarded
+		_, err := p.endTransaction(context.Background(), kgo.TryAbort)
+		if err != nil {
+			log.Printf("FranzProducer failed to abort transaction: %+v", err)
+		}
+	}
+
 	p.client.Close()
 
+	if p.deadLetters != nil {
+		return p.deadLetters.Close()
+	}
+	return nil
+}
+
+func (p *FranzProducer) Transactional() bool {
+	return p.transactional
+}
+
+// Commit ends the current transaction with marker and starts the next one
+// the transaction is aborted if any of it's records failed
+func (p *FranzProducer) Commit(marker *RecordBuffer) error {
+	if !p.transactional {
+		marker.Release()
+		return errors.New("producer isn't transactional")
+	}
+
+	ctx := context.Background()
+	err := p.TopicWriter(CheckpointTopic).WriteRecord(RecordKey{Key: []byte(p.name)}, marker)
+	if err == nil {
+		err = p.client.Flush(ctx)
+	}
+	if err == nil {
+		err = p.Err()
+	}
+
+	if err != nil {
+		_, abortErr := p.endTransaction(ctx, kgo.TryAbort)
+		if abortErr != nil {
+			log.Printf("FranzProducer failed to abort transaction: %+v", abortErr)
+			return errors.Wrap(err, "aborted transaction")
+		}
+
+		// the failed record was discarded with the transaction, so the next
+		// one can start unless we're failing fast
+		if !p.failFast {
+			p.mu.Lock()
+			p.err = nil
+			p.mu.Unlock()
+		}
+		beginErr := p.client.BeginTransaction()
+		if beginErr != nil {
+			return errors.WithStack(beginErr)
+		}
+		return errors.Wrap(err, "aborted transaction")
+	}
+
+	committed, err := p.endTransaction(ctx, kgo.TryCommit)
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	err = p.client.BeginTransaction()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !committed {
+		return ErrTransactionAborted
+	}
 	return nil
 }
 
+// endTransaction ends the current transaction and returns true if it was
+// committed, along with the offsets consumed in it when consuming
+func (p *FranzProducer) endTransaction(ctx context.Context, commit kgo.TransactionEndTry) (bool, error) {
+	if p.session != nil {
+		return p.session.End(ctx, commit)
+	}
+	if commit == kgo.TryAbort {
+		err := p.client.AbortBufferedRecords(ctx)
+		if err != nil {
+			return false, err
+		}
+	}
+	err := p.client.EndTransaction(ctx, commit)
+	return err == nil && bool(commit), err
+}
+
+// lastCommitIdle is how long LastCommit waits for more markers before
+// deciding it has read all of them
+const lastCommitIdle = 5 * time.Second
+
+// LastCommit reads every committed marker and returns the last one written
+// by this producer
+func (p *FranzProducer) LastCommit() ([]byte, error) {
+	consumer, err := NewFranzConsumer(p.config, CheckpointTopic, "")
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	var last []byte
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), lastCommitIdle)
+		records, err := consumer.Poll(ctx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			return nil, err
+		}
+		if len(records) == 0 && ctx.Err() != nil {
+			return last, nil
+		}
+		for _, r := range records {
+			if string(r.Key) == p.name {
+				last = r.Value
+			}
+		}
+	}
+}
+
 type FranzWriter struct {
 	p     *FranzProducer
 	topic string
 }
 
-func (w *FranzWriter) Write(d []byte) (int, error) {
+func (w *FranzWriter) WriteRecord(key RecordKey, b *RecordBuffer) error {
+	w.p.closeMu.RLock()
 	if w.p.Closed() {
-		return 0, syscall.EINVAL
+		w.p.closeMu.RUnlock()
+		b.Release()
+		return syscall.EINVAL
 	}
+	w.p.pendingWrites.Add(1)
+	w.p.closeMu.RUnlock()
 
-	r := kgo.SliceRecord(d)
+	if err := w.p.Err(); err != nil {
+		w.p.pendingWrites.Done()
+		b.Release()
+		return err
+	}
+
+	// the record shares b's bytes until it's produced or failed
+	r := kgo.SliceRecord(b.B)
 	r.Topic = w.topic
+	r.Key = key.Key
+	if key.PartitionKey != nil {
+		r.Headers = []kgo.RecordHeader{{Key: PartitionKeyHeader, Value: key.PartitionKey}}
+	}
 
-	w.p.pendingWrites.Add(1)
+	// Produce blocks while the producer has max_buffered_records waiting which
+	// slows the simulation down to the rate records can be produced
+	start := time.Now()
 	w.p.client.Produce(context.Background(), r, func(r *kgo.Record, err error) {
 		defer w.p.pendingWrites.Done()
+		// records are only dropped by a closed client when the producer is
+		// shutting down
 		if err != nil && err != kgo.ErrClientClosed {
-			log.Printf("FranzProducer error on topic %s: %+v", w.topic, err)
+			w.p.fail(w.topic, key, b.B, err)
 		}
+		b.Release()
 	})
+	produceBlocked.Add(time.Since(start).Seconds())
 
-	return len(d), nil
+	return nil
+}
+
+// partitionKeyPartitioner hashes the partition key header of each record, or
+// it's key when the header isn't set, the same way as kafka's default partitioner
+type partitionKeyPartitioner struct{}
+
+func (partitionKeyPartitioner) ForTopic(topic string) kgo.TopicPartitioner {
+	return &partitionKeyTopicPartitioner{
+		keyed: kgo.StickyKeyPartitioner(nil).ForTopic(topic),
+	}
+}
+
+type partitionKeyTopicPartitioner struct {
+	keyed kgo.TopicPartitioner
+}
+
+func (p *partitionKeyTopicPartitioner) OnNewBatch() {
+	p.keyed.OnNewBatch()
+}
+
+func (p *partitionKeyTopicPartitioner) RequiresConsistency(r *kgo.Record) bool {
+	return p.keyed.RequiresConsistency(&kgo.Record{Key: partitionKey(r)})
+}
+
+func (p *partitionKeyTopicPartitioner) Partition(r *kgo.Record, n int) int {
+	return p.keyed.Partition(&kgo.Record{Key: partitionKey(r)}, n)
+}
+
+func partitionKey(r *kgo.Record) []byte {
+	for _, h := range r.Headers {
+		if h.Key == PartitionKeyHeader {
+			return h.Value
+		}
+	}
+	return r.Key
 }
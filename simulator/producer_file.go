@@ -0,0 +1,409 @@
+package simulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// FileProducer writes each topic to its own file in a directory
+// every record is prefixed by its length as a 4 byte big endian integer
+// keys aren't written; each file is a single ordered stream
+//
+// a transactional FileProducer stands in for kafka transactions: records are
+// kept in memory until they're committed, and the size of every topic file
+// after each commit is saved in the directory's committed file. files are
+// truncated to their committed size when the producer is created, and
+// FileConsumers don't read past it
+type FileProducer struct {
+	mu     sync.Mutex
+	dir    string
+	files  map[string]*os.File
+	bufs   map[string]*bufio.Writer
+	closed bool
+
+	transactional bool
+	pending       map[string][]*RecordBuffer
+	committed     map[string]int64
+	err           error // set when an aborted transaction couldn't be rolled back
+}
+
+var _ TransactionalProducer = &FileProducer{}
+
+// committedFile is the name of the file containing the committed size of
+// every topic file written by a transactional FileProducer
+const committedFile = "committed"
+
+func NewFileProducer(dir string, transactional bool) (*FileProducer, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	p := &FileProducer{
+		dir:           dir,
+		files:         make(map[string]*os.File),
+		bufs:          make(map[string]*bufio.Writer),
+		transactional: transactional,
+		pending:       make(map[string][]*RecordBuffer),
+	}
+	if transactional {
+		err = p.recover()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// recover truncates every topic file to it's committed size, which discards
+// records a previous producer wrote without committing
+// output written without transactions is treated as committed
+func (p *FileProducer) recover() error {
+	paths, err := filepath.Glob(filepath.Join(p.dir, "*.bin"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	committed, err := readCommitted(p.dir)
+	if err != nil {
+		return err
+	}
+	if committed == nil {
+		committed = make(map[string]int64)
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			committed[strings.TrimSuffix(filepath.Base(path), ".bin")] = info.Size()
+		}
+		err = writeCommitted(p.dir, committed)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, path := range paths {
+		topic := strings.TrimSuffix(filepath.Base(path), ".bin")
+		err = os.Truncate(path, committed[topic])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	p.committed = committed
+	return nil
+}
+
+// readCommitted returns the committed size of each topic file in dir or nil
+// if dir wasn't written by a transactional producer
+func readCommitted(dir string) (map[string]int64, error) {
+	f, err := os.Open(filepath.Join(dir, committedFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	committed := make(map[string]int64)
+	err = gob.NewDecoder(f).Decode(&committed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", f.Name())
+	}
+	return committed, nil
+}
+
+// writeCommitted atomically replaces the committed file, which commits the
+// records written before it
+func writeCommitted(dir string, committed map[string]int64) error {
+	path := filepath.Join(dir, committedFile)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	err = gob.NewEncoder(f).Encode(committed)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpPath, path))
+}
+
+// TopicPath returns the path of the file containing the topic's records
+func (p *FileProducer) TopicPath(topic string) string {
+	return filepath.Join(p.dir, topic+".bin")
+}
+
+func (p *FileProducer) TopicWriter(topic string) RecordWriter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		panic("closed")
+	}
+
+	return &FileWriter{p: p, topic: topic}
+}
+
+func (p *FileProducer) write(topic string, b *RecordBuffer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		b.Release()
+		return syscall.EINVAL
+	}
+	if p.err != nil {
+		b.Release()
+		return p.err
+	}
+
+	if p.transactional {
+		p.pending[topic] = append(p.pending[topic], b)
+		return nil
+	}
+	defer b.Release()
+	return p.append(topic, b.B)
+}
+
+// append writes a record to the end of the topic's file
+func (p *FileProducer) append(topic string, d []byte) error {
+	buf, ok := p.bufs[topic]
+	if !ok {
+		// append so a resumed simulation extends the existing output
+		f, err := os.OpenFile(p.TopicPath(topic), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		buf = bufio.NewWriterSize(f, 1<<20)
+		p.files[topic] = f
+		p.bufs[topic] = buf
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(d)))
+	if _, err := buf.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := buf.Write(d)
+	return err
+}
+
+// Flush writes buffered records to their files
+// records which haven't been committed stay in memory
+func (p *FileProducer) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, buf := range p.bufs {
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *FileProducer) Transactional() bool {
+	return p.transactional
+}
+
+// Commit writes every pending record and the marker to their files, syncs
+// them and then records their new sizes in the committed file
+// if any step fails the transaction is aborted and the files are truncated
+// to their committed size again
+func (p *FileProducer) Commit(marker *RecordBuffer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.transactional {
+		marker.Release()
+		return errors.New("producer isn't transactional")
+	}
+	if p.closed {
+		marker.Release()
+		return syscall.EINVAL
+	}
+	if p.err != nil {
+		marker.Release()
+		return p.err
+	}
+	p.pending[CheckpointTopic] = append(p.pending[CheckpointTopic], marker)
+
+	committed := make(map[string]int64, len(p.committed))
+	for topic, size := range p.committed {
+		committed[topic] = size
+	}
+
+	var err error
+	touched := make([]string, 0, len(p.pending))
+	for topic, records := range p.pending {
+		touched = append(touched, topic)
+		for _, b := range records {
+			if err == nil {
+				err = p.append(topic, b.B)
+				committed[topic] += int64(4 + len(b.B))
+			}
+			b.Release()
+		}
+		delete(p.pending, topic)
+		if err != nil {
+			continue
+		}
+
+		err = p.bufs[topic].Flush()
+		if err == nil {
+			err = errors.WithStack(p.files[topic].Sync())
+		}
+	}
+	if err != nil {
+		p.rollback(touched)
+		return errors.Wrap(err, "aborted transaction")
+	}
+
+	err = writeCommitted(p.dir, committed)
+	if err != nil {
+		p.rollback(touched)
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	p.committed = committed
+	return nil
+}
+
+// rollback discards whatever an aborted transaction wrote to the topics'
+// files so the next commit doesn't include it
+// if a file can't be truncated every later write and commit fails
+func (p *FileProducer) rollback(topics []string) {
+	for _, topic := range topics {
+		f, ok := p.files[topic]
+		if !ok {
+			continue
+		}
+		p.bufs[topic].Reset(f)
+		err := f.Truncate(p.committed[topic])
+		if err != nil && p.err == nil {
+			p.err = errors.Wrapf(err, "failed to roll back %s", topic)
+		}
+	}
+}
+
+// LastCommit returns the last marker in the directory's checkpoint topic file
+// the file only contains committed records since it's truncated when the
+// producer is created
+func (p *FileProducer) LastCommit() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.transactional {
+		return nil, errors.New("producer isn't transactional")
+	}
+	if buf, ok := p.bufs[CheckpointTopic]; ok {
+		if err := buf.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	records, _, err := readRecordsFrom(p.TopicPath(CheckpointTopic), 0, p.committed[CheckpointTopic])
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return records[len(records)-1], nil
+}
+
+func (p *FileProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errors.New("already closed")
+	}
+	p.closed = true
+
+	// records which weren't committed are discarded
+	for topic, records := range p.pending {
+		for _, b := range records {
+			b.Release()
+		}
+		delete(p.pending, topic)
+	}
+
+	var firstErr error
+	for topic, f := range p.files {
+		if err := p.bufs[topic].Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+type FileWriter struct {
+	p     *FileProducer
+	topic string
+}
+
+func (w *FileWriter) WriteRecord(_ RecordKey, b *RecordBuffer) error {
+	return w.p.write(w.topic, b)
+}
+
+// ReadFileRecords calls fn with each record in a file written by FileProducer
+// the slice passed to fn is only valid until fn returns
+func ReadFileRecords(r io.Reader, fn func([]byte) error) error {
+	br := bufio.NewReader(r)
+	var header [4]byte
+	var d []byte
+
+	for {
+		_, err := io.ReadFull(br, header[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		n := int(binary.BigEndian.Uint32(header[:]))
+		if cap(d) < n {
+			d = make([]byte, n)
+		}
+		d = d[:n]
+
+		_, err = io.ReadFull(br, d)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = fn(d)
+		if err != nil {
+			return err
+		}
+	}
+}
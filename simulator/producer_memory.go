@@ -0,0 +1,85 @@
+package simulator
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryProducer keeps every record in memory, grouped by topic
+// it's intended for tests and short offline runs
+// written buffers are kept rather than copied so reusing a buffer after
+// writing it corrupts the kept records
+type MemoryProducer struct {
+	mu      sync.Mutex
+	records map[string][]*RecordBuffer
+	closed  bool
+}
+
+var _ Producer = &MemoryProducer{}
+
+func NewMemoryProducer() *MemoryProducer {
+	return &MemoryProducer{
+		records: make(map[string][]*RecordBuffer),
+	}
+}
+
+func (p *MemoryProducer) TopicWriter(topic string) RecordWriter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		panic("closed")
+	}
+
+	return &MemoryWriter{p: p, topic: topic}
+}
+
+// Records returns the records written to topic in the order they were written
+func (p *MemoryProducer) Records(topic string) [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([][]byte, len(p.records[topic]))
+	for i, b := range p.records[topic] {
+		out[i] = b.B
+	}
+	return out
+}
+
+func (p *MemoryProducer) Flush() error {
+	return nil
+}
+
+func (p *MemoryProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errors.New("already closed")
+	}
+	p.closed = true
+
+	return nil
+}
+
+type MemoryWriter struct {
+	p     *MemoryProducer
+	topic string
+}
+
+func (w *MemoryWriter) WriteRecord(_ RecordKey, b *RecordBuffer) error {
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+
+	if w.p.closed {
+		b.Release()
+		return syscall.EINVAL
+	}
+
+	// the buffer is never released so it's bytes stay valid
+	w.p.records[w.topic] = append(w.p.records[w.topic], b)
+
+	return nil
+}
@@ -0,0 +1,453 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"simulator/enum"
+)
+
+// referenceProducer copies every record written to it
+// it's independent of the producers under test so it's records can be trusted
+type referenceProducer struct {
+	records map[string][][]byte
+}
+
+func (p *referenceProducer) TopicWriter(topic string) RecordWriter {
+	return &referenceWriter{p: p, topic: topic}
+}
+
+func (p *referenceProducer) Flush() error { return nil }
+func (p *referenceProducer) Close() error { return nil }
+
+type referenceWriter struct {
+	p     *referenceProducer
+	topic string
+}
+
+func (w *referenceWriter) WriteRecord(_ RecordKey, b *RecordBuffer) error {
+	d := make([]byte, len(b.B))
+	copy(d, b.B)
+	b.Release()
+	w.p.records[w.topic] = append(w.p.records[w.topic], d)
+	return nil
+}
+
+// asyncProducer produces records on another goroutine after a delay and
+// releases their buffers in a callback, like the FranzProducer does
+type asyncProducer struct {
+	records chan asyncRecord
+	pending sync.WaitGroup
+	done    chan struct{}
+
+	mu       sync.Mutex
+	produced map[string][][]byte
+}
+
+type asyncRecord struct {
+	topic string
+	b     *RecordBuffer
+}
+
+func newAsyncProducer() *asyncProducer {
+	p := &asyncProducer{
+		records:  make(chan asyncRecord, 64),
+		done:     make(chan struct{}),
+		produced: make(map[string][][]byte),
+	}
+	go func() {
+		defer close(p.done)
+		for i := 0; ; i++ {
+			r, ok := <-p.records
+			if !ok {
+				return
+			}
+			// let the writers get ahead so buffers wait to be produced
+			if i%50 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			p.callback(r)
+		}
+	}()
+	return p
+}
+
+func (p *asyncProducer) callback(r asyncRecord) {
+	defer p.pending.Done()
+	d := make([]byte, len(r.b.B))
+	copy(d, r.b.B)
+	r.b.Release()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.produced[r.topic] = append(p.produced[r.topic], d)
+}
+
+func (p *asyncProducer) TopicWriter(topic string) RecordWriter {
+	return &asyncWriter{p: p, topic: topic}
+}
+
+func (p *asyncProducer) Flush() error {
+	p.pending.Wait()
+	return nil
+}
+
+func (p *asyncProducer) Close() error {
+	close(p.records)
+	<-p.done
+	return nil
+}
+
+type asyncWriter struct {
+	p     *asyncProducer
+	topic string
+}
+
+func (w *asyncWriter) WriteRecord(_ RecordKey, b *RecordBuffer) error {
+	w.p.pending.Add(1)
+	w.p.records <- asyncRecord{topic: w.topic, b: b}
+	return nil
+}
+
+// TestConcurrentWrites writes records from many goroutines sharing a producer
+// and checks every record is read back exactly as it was encoded
+// a record buffer which was reused before the record was written shows up as
+// a missing record
+func TestConcurrentWrites(t *testing.T) {
+	const (
+		workers = 32
+		records = 200
+	)
+	kinds := []enum.TransitionKind{enum.ArrivalScan, enum.DepartureScan, enum.ExceptionDelay, enum.Delivered}
+	topics := []string{"packages", "transitions"}
+	schemaIDs := testSchemaIDs(t)
+
+	for _, backend := range []string{MemoryBackend, FileBackend, "async"} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			var producer Producer
+			if backend == "async" {
+				producer = newAsyncProducer()
+			} else {
+				var err error
+				producer, err = NewProducer(TopicsConfig{Backend: backend, Directory: dir}, "test")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			keys := NewRecordKeys(PackagePartitioner, "test", &World{})
+
+			var mu sync.Mutex
+			expected := make(map[string]map[string]int)
+			for _, topic := range topics {
+				expected[topic] = make(map[string]int)
+			}
+
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+
+					out := NewTopics(producer, schemaIDs, keys)
+					ref := &referenceProducer{records: make(map[string][][]byte)}
+					refOut := NewTopics(ref, schemaIDs, keys)
+
+					for i := 0; i < records; i++ {
+						tracker := &Tracker{
+							PackageID:                     uuid.NewV4(),
+							Method:                        enum.Standard,
+							OriginLocationID:              int64(w),
+							DestinationLocationID:         int64(i),
+							OriginalDestinationLocationID: int64(i),
+							Seq:                           i,
+							LastLocationID:                int64(w),
+							NextLocationID:                int64(i),
+							Mode:                          enum.Land,
+						}
+						now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second)
+						pkg := &Package{
+							PackageID:             tracker.PackageID,
+							SimulatorID:           fmt.Sprintf("test-%d", w),
+							Received:              now,
+							OriginLocationID:      tracker.OriginLocationID,
+							DestinationLocationID: tracker.DestinationLocationID,
+							// vary the record size
+							DeliveryEstimate: now.Add(time.Duration(i*i) * time.Hour),
+							Method:           enum.Standard,
+						}
+
+						for _, o := range []*Topics{refOut, out} {
+							if err := o.WritePackage(pkg); err != nil {
+								t.Error(err)
+								return
+							}
+							if err := o.WriteTransition(now, kinds[i%len(kinds)], tracker); err != nil {
+								t.Error(err)
+								return
+							}
+						}
+					}
+
+					mu.Lock()
+					defer mu.Unlock()
+					for _, topic := range topics {
+						for _, r := range ref.records[topic] {
+							expected[topic][string(r)]++
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			if err := producer.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, topic := range topics {
+				var consumed [][]byte
+				switch p := producer.(type) {
+				case *MemoryProducer:
+					consumed = p.Records(topic)
+				case *asyncProducer:
+					consumed = p.produced[topic]
+				default:
+					consumer, err := NewFileConsumer(dir, topic, "")
+					if err != nil {
+						t.Fatal(err)
+					}
+					for {
+						rs, err := consumer.read()
+						if err != nil {
+							t.Fatal(err)
+						}
+						if len(rs) == 0 {
+							break
+						}
+						for _, r := range rs {
+							consumed = append(consumed, r.Value)
+						}
+					}
+				}
+
+				if len(consumed) != workers*records {
+					t.Errorf("%s: expected %d records, got %d", topic, workers*records, len(consumed))
+				}
+				remaining := expected[topic]
+				for _, r := range consumed {
+					if remaining[string(r)] == 0 {
+						t.Errorf("%s: read a record which wasn't written: %x", topic, r)
+						continue
+					}
+					remaining[string(r)]--
+				}
+			}
+
+			if err := producer.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFileProducerCommitRollback(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewFileProducer(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	write := func(topic string, d string) {
+		b := NewRecordBuffer()
+		b.B = append(b.B, d...)
+		if err := p.TopicWriter(topic).WriteRecord(RecordKey{}, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func(marker string) error {
+		b := NewRecordBuffer()
+		b.B = append(b.B, marker...)
+		return p.Commit(b)
+	}
+
+	write("packages", "a")
+	if err := commit("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory in the way of the committed file fails the next commit
+	// after it's records were appended
+	tmpPath := filepath.Join(dir, committedFile+".tmp")
+	if err := os.Mkdir(tmpPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write("packages", "b")
+	write("transitions", "c")
+	if err := commit("2"); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+	if err := os.Remove(tmpPath); err != nil {
+		t.Fatal(err)
+	}
+
+	write("packages", "d")
+	if err := commit("3"); err != nil {
+		t.Fatal(err)
+	}
+
+	for topic, want := range map[string][]string{
+		"packages":      {"a", "d"},
+		"transitions":   nil,
+		CheckpointTopic: {"1", "3"},
+	} {
+		records, _, err := readRecordsFrom(p.TopicPath(topic), 0, p.committed[topic])
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(p.TopicPath(topic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != p.committed[topic] {
+			t.Errorf("%s: expected the file to be truncated to %d bytes, it's %d", topic, p.committed[topic], info.Size())
+		}
+		got := make([]string, 0, len(records))
+		for _, r := range records {
+			got = append(got, string(r))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: expected records %v, got %v", topic, want, got)
+		}
+	}
+}
+
+// transactClient stands in for a transactional kgo.Client
+// it fails the records in failTopic and calls promises on another goroutine
+type transactClient struct {
+	mu        sync.Mutex
+	inTxn     bool
+	pending   []*kgo.Record
+	committed []string
+	failTopic string
+	promises  sync.WaitGroup
+}
+
+func (c *transactClient) Produce(_ context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	if !c.inTxn {
+		err = errors.New("produce outside of a transaction")
+	} else if r.Topic == c.failTopic {
+		err = errors.New("record failed")
+	} else {
+		c.pending = append(c.pending, r)
+	}
+
+	c.promises.Add(1)
+	go func() {
+		defer c.promises.Done()
+		promise(r, err)
+	}()
+}
+
+func (c *transactClient) Flush(context.Context) error {
+	c.promises.Wait()
+	return nil
+}
+
+func (c *transactClient) BeginTransaction() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inTxn {
+		return errors.New("transaction already begun")
+	}
+	c.inTxn = true
+	return nil
+}
+
+func (c *transactClient) AbortBufferedRecords(context.Context) error {
+	c.promises.Wait()
+	return nil
+}
+
+func (c *transactClient) EndTransaction(_ context.Context, commit kgo.TransactionEndTry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.inTxn {
+		return errors.New("no transaction to end")
+	}
+	if commit {
+		for _, r := range c.pending {
+			c.committed = append(c.committed, fmt.Sprintf("%s:%s", r.Topic, r.Value))
+		}
+	}
+	c.pending = nil
+	c.inTxn = false
+	return nil
+}
+
+func (c *transactClient) Close() {}
+
+func TestFranzProducerCommitAfterAbort(t *testing.T) {
+	client := &transactClient{inTxn: true}
+	p := &FranzProducer{name: "test", transactional: true, client: client}
+
+	write := func(topic string, d string) error {
+		b := NewRecordBuffer()
+		b.B = append(b.B, d...)
+		return p.TopicWriter(topic).WriteRecord(RecordKey{}, b)
+	}
+	commit := func(marker string) error {
+		b := NewRecordBuffer()
+		b.B = append(b.B, marker...)
+		return p.Commit(b)
+	}
+
+	if err := write("packages", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed record aborts the transaction along with the records before it
+	client.failTopic = "transitions"
+	if err := write("packages", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("transitions", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit("2"); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+	client.failTopic = ""
+
+	// the next transaction commits
+	if err := write("packages", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit("3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"packages:a", CheckpointTopic + ":1", "packages:d", CheckpointTopic + ":3"}
+	if fmt.Sprint(client.committed) != fmt.Sprint(want) {
+		t.Errorf("expected %v to be committed, got %v", want, client.committed)
+	}
+}
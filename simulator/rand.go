@@ -0,0 +1,45 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// randSource adapts a math/rand.Rand to the golang.org/x/exp/rand.Source
+// interface used by the gonum distributions
+type randSource struct {
+	r *rand.Rand
+}
+
+func (s randSource) Uint64() uint64 {
+	return s.r.Uint64()
+}
+
+func (s randSource) Seed(seed uint64) {
+	s.r.Seed(int64(seed))
+}
+
+// NewPackageID returns a random (version 4) UUID generated from r
+func NewPackageID(r *rand.Rand) uuid.UUID {
+	var id uuid.UUID
+	r.Read(id[:])
+	id.SetVersion(uuid.V4)
+	id.SetVariant(uuid.VariantRFC4122)
+	return id
+}
+
+// workerSeed derives a worker's seed from the simulator id, the configured
+// seed and the worker, so simulators sharing a seed don't generate the same
+// package ids
+func workerSeed(simulatorID string, seed int64, worker int) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(simulatorID))
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], uint64(seed))
+	binary.LittleEndian.PutUint64(b[8:], uint64(worker))
+	h.Write(b[:])
+	return int64(h.Sum64())
+}
@@ -0,0 +1,31 @@
+package simulator
+
+import (
+	"math/rand"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestWorkerSeedPackageIDs(t *testing.T) {
+	seen := make(map[uuid.UUID]string)
+	for _, id := range []string{"europe", "asia"} {
+		for worker := 0; worker < 4; worker++ {
+			// adjacent seeds overlapped when the worker was added to the seed
+			for seed := int64(1); seed <= 4; seed++ {
+				r := rand.New(rand.NewSource(workerSeed(id, seed, worker)))
+				for i := 0; i < 100; i++ {
+					p := NewPackageID(r)
+					if prev, ok := seen[p]; ok {
+						t.Fatalf("%s seed %d worker %d: package id %s already generated by %s", id, seed, worker, p, prev)
+					}
+					seen[p] = id
+				}
+			}
+		}
+	}
+
+	if workerSeed("europe", 1, 0) != workerSeed("europe", 1, 0) {
+		t.Fatal("expected the same worker seed for the same simulator, seed and worker")
+	}
+}
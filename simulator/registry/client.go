@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Client talks to a Confluent compatible schema registry
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+func NewClient(url string) *Client {
+	return &Client{
+		url:  strings.TrimRight(url, "/"),
+		http: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Register adds schema to subject and returns it's id
+// registering the same schema again returns the existing id
+func (c *Client) Register(subject string, schema string) (int, error) {
+	body, err := json.Marshal(schemaRequest{Schema: schema})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	var out schemaResponse
+	err = c.do(http.MethodPost, fmt.Sprintf("/subjects/%s/versions", subject), body, &out)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to register schema for %s", subject)
+	}
+	return out.ID, nil
+}
+
+// Schema returns the schema with the given id
+func (c *Client) Schema(id int) (string, error) {
+	var out schemaResponse
+	err := c.do(http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &out)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to get schema %d", id)
+	}
+	return out.Schema, nil
+}
+
+func (c *Client) do(method string, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var e errorResponse
+		if json.NewDecoder(res.Body).Decode(&e) == nil && e.Message != "" {
+			return errors.Errorf("%s (%d)", e.Message, e.ErrorCode)
+		}
+		return errors.Errorf("unexpected status %s", res.Status)
+	}
+
+	return errors.WithStack(json.NewDecoder(res.Body).Decode(out))
+}
@@ -0,0 +1,230 @@
+// Package registry implements a small Confluent compatible schema registry
+// along with a client and the wire format used to frame records.
+//
+// The registry keeps every schema in memory and optionally persists them to a
+// json file. It doesn't check compatibility between versions of a subject.
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/hamba/avro"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrSubjectNotFound = errors.New("subject not found")
+	ErrVersionNotFound = errors.New("version not found")
+	ErrSchemaNotFound  = errors.New("schema not found")
+	ErrInvalidSchema   = errors.New("invalid schema")
+)
+
+// state is the part of the registry persisted to disk
+type state struct {
+	// Schemas contains every registered schema, the schema with id i is at index i-1
+	Schemas []string `json:"schemas"`
+
+	// Subjects contains the schema id of each version of a subject, the
+	// version v is at index v-1
+	Subjects map[string][]int `json:"subjects"`
+}
+
+type Registry struct {
+	mu    sync.Mutex
+	path  string
+	state state
+	ids   map[string]int
+}
+
+// Open loads the registry persisted at path
+// set path to "" to keep the registry in memory
+func Open(path string) (*Registry, error) {
+	r := &Registry{
+		path: path,
+		state: state{
+			Schemas:  make([]string, 0),
+			Subjects: make(map[string][]int),
+		},
+		ids: make(map[string]int),
+	}
+
+	if path == "" {
+		return r, nil
+	}
+
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = json.Unmarshal(d, &r.state)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to decode registry %s", path)
+	}
+	if r.state.Subjects == nil {
+		r.state.Subjects = make(map[string][]int)
+	}
+	for i, schema := range r.state.Schemas {
+		r.ids[schema] = i + 1
+	}
+
+	return r, nil
+}
+
+// canonical returns the parsing canonical form of an avro schema so schemas
+// which only differ by formatting share an id
+func canonical(schema string) (string, error) {
+	s, err := avro.Parse(schema)
+	if err != nil {
+		return "", errors.Wrap(ErrInvalidSchema, err.Error())
+	}
+	return s.String(), nil
+}
+
+// Register adds schema to subject unless it's already registered and returns
+// it's id and version
+func (r *Registry) Register(subject string, schema string) (int, int, error) {
+	schema, err := canonical(schema)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, ok := r.ids[schema]
+	if !ok {
+		r.state.Schemas = append(r.state.Schemas, schema)
+		id = len(r.state.Schemas)
+		r.ids[schema] = id
+	}
+
+	versions := r.state.Subjects[subject]
+	for i, existing := range versions {
+		if existing == id {
+			return id, i + 1, nil
+		}
+	}
+	r.state.Subjects[subject] = append(versions, id)
+
+	err = r.save()
+	if err != nil {
+		return 0, 0, err
+	}
+	return id, len(versions) + 1, nil
+}
+
+// save atomically replaces the registry file
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	d, err := json.MarshalIndent(&r.state, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(r.path), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpPath := r.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, d, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpPath, r.path))
+}
+
+// Lookup returns the id and version of a schema registered with subject
+func (r *Registry) Lookup(subject string, schema string) (int, int, error) {
+	schema, err := canonical(schema)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions, ok := r.state.Subjects[subject]
+	if !ok {
+		return 0, 0, ErrSubjectNotFound
+	}
+	id, ok := r.ids[schema]
+	if ok {
+		for i, existing := range versions {
+			if existing == id {
+				return id, i + 1, nil
+			}
+		}
+	}
+	return 0, 0, ErrSchemaNotFound
+}
+
+// Schema returns the schema with the given id
+func (r *Registry) Schema(id int) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id < 1 || id > len(r.state.Schemas) {
+		return "", ErrSchemaNotFound
+	}
+	return r.state.Schemas[id-1], nil
+}
+
+// Subjects returns every subject in alphabetical order
+func (r *Registry) Subjects() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]string, 0, len(r.state.Subjects))
+	for subject := range r.state.Subjects {
+		out = append(out, subject)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Versions returns the versions of a subject
+func (r *Registry) Versions(subject string) ([]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions, ok := r.state.Subjects[subject]
+	if !ok {
+		return nil, ErrSubjectNotFound
+	}
+	out := make([]int, len(versions))
+	for i := range versions {
+		out[i] = i + 1
+	}
+	return out, nil
+}
+
+// Version returns the id and schema of a version of subject
+// set version to -1 for the latest version
+func (r *Registry) Version(subject string, version int) (int, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions, ok := r.state.Subjects[subject]
+	if !ok {
+		return 0, "", ErrSubjectNotFound
+	}
+	if version == -1 {
+		version = len(versions)
+	}
+	if version < 1 || version > len(versions) {
+		return 0, "", ErrVersionNotFound
+	}
+	id := versions[version-1]
+	return id, r.state.Schemas[id-1], nil
+}
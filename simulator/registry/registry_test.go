@@ -0,0 +1,260 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testSchema = `{"type": "record", "name": "Test", "fields": [{"name": "A", "type": "long"}]}`
+
+	// the same schema formatted differently
+	testSchemaReformatted = `{
+		"name": "Test",
+		"type": "record",
+		"fields": [ { "type": "long", "name": "A" } ]
+	}`
+
+	otherSchema = `{"type": "record", "name": "Other", "fields": [{"name": "B", "type": "string"}]}`
+)
+
+func newTestServer(t *testing.T, r *Registry) *Client {
+	t.Helper()
+	srv := httptest.NewServer(NewServer(r))
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL)
+}
+
+func TestRegisterIdempotent(t *testing.T) {
+	r, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestServer(t, r)
+
+	id, err := c.Register("test-value", testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Errorf("expected the first schema to have id 1, got %d", id)
+	}
+
+	again, err := c.Register("test-value", testSchemaReformatted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != id {
+		t.Errorf("registering the same schema again returned id %d, expected %d", again, id)
+	}
+
+	shared, err := c.Register("shared-value", testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared != id {
+		t.Errorf("subjects with the same schema should share id %d, got %d", id, shared)
+	}
+
+	other, err := c.Register("test-value", otherSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == id {
+		t.Errorf("a different schema was given the same id %d", id)
+	}
+
+	versions, err := r.Versions("test-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("expected 2 versions of test-value, got %v", versions)
+	}
+}
+
+func TestClientSchema(t *testing.T) {
+	r, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestServer(t, r)
+
+	id, err := c.Register("test-value", testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := c.Schema(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := canonical(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema != want {
+		t.Errorf("expected schema %s, got %s", want, schema)
+	}
+
+	_, err = c.Schema(id + 1)
+	if err == nil {
+		t.Error("expected an error for an unknown schema id")
+	}
+
+	_, err = c.Register("test-value", `{"type": "nope"}`)
+	if err == nil {
+		t.Error("expected an error registering an invalid schema")
+	}
+}
+
+func TestServer(t *testing.T) {
+	r, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewServer(r))
+	defer srv.Close()
+
+	id, _, err := r.Register("test-value", testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string, status int, out interface{}) {
+		t.Helper()
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("GET %s: expected status %d, got %d", path, status, res.StatusCode)
+		}
+		if out != nil {
+			if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var subjects []string
+	get("/subjects", http.StatusOK, &subjects)
+	if len(subjects) != 1 || subjects[0] != "test-value" {
+		t.Errorf("unexpected subjects %v", subjects)
+	}
+
+	var versions []int
+	get("/subjects/test-value/versions", http.StatusOK, &versions)
+	if len(versions) != 1 || versions[0] != 1 {
+		t.Errorf("unexpected versions %v", versions)
+	}
+
+	var latest schemaResponse
+	get("/subjects/test-value/versions/latest", http.StatusOK, &latest)
+	if latest.ID != id || latest.Version != 1 || latest.Subject != "test-value" {
+		t.Errorf("unexpected latest version %+v", latest)
+	}
+
+	var e errorResponse
+	get("/subjects/missing/versions", http.StatusNotFound, &e)
+	if e.ErrorCode != codeSubjectNotFound {
+		t.Errorf("expected error code %d, got %d", codeSubjectNotFound, e.ErrorCode)
+	}
+	get("/subjects/test-value/versions/2", http.StatusNotFound, &e)
+	if e.ErrorCode != codeVersionNotFound {
+		t.Errorf("expected error code %d, got %d", codeVersionNotFound, e.ErrorCode)
+	}
+
+	// looking up a schema returns it's id and version without registering it
+	body, _ := json.Marshal(schemaRequest{Schema: testSchemaReformatted})
+	res, err := http.Post(srv.URL+"/subjects/test-value", contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found schemaResponse
+	err = json.NewDecoder(res.Body).Decode(&found)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != id || found.Version != 1 {
+		t.Errorf("unexpected lookup result %+v", found)
+	}
+
+	body, _ = json.Marshal(schemaRequest{Schema: otherSchema})
+	res, err = http.Post(srv.URL+"/subjects/test-value", contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("looking up an unregistered schema: expected status 404, got %d", res.StatusCode)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testID, _, err := r.Register("test-value", testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, _, err := r.Register("other-value", otherSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a registry reopened from the file assigns the same ids
+	r, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestServer(t, r)
+	for subject, schema := range map[string]string{"test-value": testSchema, "other-value": otherSchema} {
+		id, err := c.Register(subject, schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := testID
+		if subject == "other-value" {
+			want = otherID
+		}
+		if id != want {
+			t.Errorf("%s: expected id %d after reopening, got %d", subject, want, id)
+		}
+	}
+}
+
+func TestFrame(t *testing.T) {
+	record := []byte{1, 2, 3}
+
+	framed := Frame(258, record)
+	if !bytes.Equal(framed, []byte{0, 0, 0, 1, 2, 1, 2, 3}) {
+		t.Errorf("unexpected framed record %v", framed)
+	}
+	if !bytes.Equal(AppendHeader(nil, 258), framed[:HeaderSize]) {
+		t.Errorf("AppendHeader doesn't match Frame")
+	}
+
+	id, d, err := Unframe(framed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 258 || !bytes.Equal(d, record) {
+		t.Errorf("expected id 258 and %v, got %d and %v", record, id, d)
+	}
+
+	for _, invalid := range [][]byte{nil, {0, 0, 0}, {1, 0, 0, 0, 1, 2}} {
+		if _, _, err := Unframe(invalid); err == nil {
+			t.Errorf("expected an error unframing %v", invalid)
+		}
+	}
+}
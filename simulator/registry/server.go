@@ -0,0 +1,198 @@
+package registry
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+// error codes returned by the Confluent schema registry
+const (
+	codeSubjectNotFound = 40401
+	codeVersionNotFound = 40402
+	codeSchemaNotFound  = 40403
+	codeInvalidSchema   = 42201
+	codeInvalidVersion  = 42202
+)
+
+type schemaRequest struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+type schemaResponse struct {
+	Subject string `json:"subject,omitempty"`
+	Version int    `json:"version,omitempty"`
+	ID      int    `json:"id"`
+	Schema  string `json:"schema,omitempty"`
+}
+
+type errorResponse struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// Server serves the subset of the Confluent schema registry api needed to
+// register and look up avro schemas:
+//
+//	GET  /schemas/ids/{id}
+//	GET  /subjects
+//	GET  /subjects/{subject}/versions
+//	GET  /subjects/{subject}/versions/{version|latest}
+//	POST /subjects/{subject}/versions
+//	POST /subjects/{subject}
+//	GET  /config
+type Server struct {
+	r *Registry
+}
+
+func NewServer(r *Registry) *Server {
+	return &Server{r: r}
+}
+
+// Serve starts serving the registry on addr in the background and returns it's url
+func Serve(addr string, r *Registry) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	go func() {
+		err := http.Serve(ln, NewServer(r))
+		if err != nil {
+			log.Printf("schema registry stopped: %+v", err)
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return "http://localhost:" + port, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+
+	switch {
+	case req.Method == http.MethodGet && len(parts) == 3 && parts[0] == "schemas" && parts[1] == "ids":
+		id, err := strconv.Atoi(parts[2])
+		if err != nil {
+			writeError(w, ErrSchemaNotFound)
+			return
+		}
+		schema, err := s.r.Schema(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, schemaResponse{ID: id, Schema: schema})
+
+	case req.Method == http.MethodGet && len(parts) == 1 && parts[0] == "subjects":
+		writeJSON(w, http.StatusOK, s.r.Subjects())
+
+	case req.Method == http.MethodGet && len(parts) == 1 && parts[0] == "config":
+		writeJSON(w, http.StatusOK, map[string]string{"compatibilityLevel": "NONE"})
+
+	case req.Method == http.MethodGet && len(parts) == 3 && parts[0] == "subjects" && parts[2] == "versions":
+		versions, err := s.r.Versions(parts[1])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, versions)
+
+	case req.Method == http.MethodGet && len(parts) == 4 && parts[0] == "subjects" && parts[2] == "versions":
+		version := -1
+		if parts[3] != "latest" {
+			v, err := strconv.Atoi(parts[3])
+			if err != nil || v < 1 {
+				writeJSON(w, http.StatusUnprocessableEntity, errorResponse{codeInvalidVersion, "invalid version"})
+				return
+			}
+			version = v
+		}
+		id, schema, err := s.r.Version(parts[1], version)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if version == -1 {
+			versions, _ := s.r.Versions(parts[1])
+			version = len(versions)
+		}
+		writeJSON(w, http.StatusOK, schemaResponse{Subject: parts[1], Version: version, ID: id, Schema: schema})
+
+	case req.Method == http.MethodPost && len(parts) == 3 && parts[0] == "subjects" && parts[2] == "versions":
+		body, ok := readSchemaRequest(w, req)
+		if !ok {
+			return
+		}
+		id, _, err := s.r.Register(parts[1], body.Schema)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, schemaResponse{ID: id})
+
+	case req.Method == http.MethodPost && len(parts) == 2 && parts[0] == "subjects":
+		body, ok := readSchemaRequest(w, req)
+		if !ok {
+			return
+		}
+		id, version, err := s.r.Lookup(parts[1], body.Schema)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		schema, _ := s.r.Schema(id)
+		writeJSON(w, http.StatusOK, schemaResponse{Subject: parts[1], Version: version, ID: id, Schema: schema})
+
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{http.StatusNotFound, "not found"})
+	}
+}
+
+func readSchemaRequest(w http.ResponseWriter, req *http.Request) (*schemaRequest, bool) {
+	var body schemaRequest
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, errorResponse{codeInvalidSchema, err.Error()})
+		return nil, false
+	}
+	if body.SchemaType != "" && body.SchemaType != "AVRO" {
+		writeJSON(w, http.StatusUnprocessableEntity, errorResponse{codeInvalidSchema, "only avro schemas are supported"})
+		return nil, false
+	}
+	return &body, true
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case ErrSubjectNotFound:
+		writeJSON(w, http.StatusNotFound, errorResponse{codeSubjectNotFound, err.Error()})
+	case ErrVersionNotFound:
+		writeJSON(w, http.StatusNotFound, errorResponse{codeVersionNotFound, err.Error()})
+	case ErrSchemaNotFound:
+		writeJSON(w, http.StatusNotFound, errorResponse{codeSchemaNotFound, err.Error()})
+	case ErrInvalidSchema:
+		writeJSON(w, http.StatusUnprocessableEntity, errorResponse{codeInvalidSchema, err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, errorResponse{50001, err.Error()})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("failed to write schema registry response: %v", err)
+	}
+}
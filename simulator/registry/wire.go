@@ -0,0 +1,36 @@
+package registry
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// magicByte starts every framed record
+const magicByte = 0
+
+// HeaderSize is the size of the header framing each record
+const HeaderSize = 5
+
+// Frame prefixes a record with the magic byte and the id of it's schema
+func Frame(id int, d []byte) []byte {
+	out := make([]byte, 0, HeaderSize+len(d))
+	out = AppendHeader(out, id)
+	return append(out, d...)
+}
+
+// AppendHeader appends the header of a record framed with the schema id to dst
+func AppendHeader(dst []byte, id int) []byte {
+	var header [HeaderSize]byte
+	header[0] = magicByte
+	binary.BigEndian.PutUint32(header[1:], uint32(id))
+	return append(dst, header[:]...)
+}
+
+// Unframe returns the id of the record's schema and the record without it's header
+func Unframe(d []byte) (int, []byte, error) {
+	if len(d) < HeaderSize || d[0] != magicByte {
+		return 0, nil, errors.New("record isn't framed with a schema id")
+	}
+	return int(binary.BigEndian.Uint32(d[1:HeaderSize])), d[HeaderSize:], nil
+}
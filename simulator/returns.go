@@ -0,0 +1,68 @@
+package simulator
+
+import (
+	"log"
+
+	uuid "github.com/satori/go.uuid"
+
+	"simulator/enum"
+)
+
+type ReturnsConfig struct {
+	// Probability is the chance that a delivered package is sent back to it's origin
+	Probability float64 `yaml:"probability"`
+
+	// DelayHours is how long after delivery the return is handed in
+	DelayHours DistributionConfig `yaml:"delay_hours"`
+}
+
+// ScheduleReturn occasionally schedules a return for a delivered package
+// the return is received at the package's destination after a random delay
+func ScheduleReturn(state *State, t *Tracker) {
+	// returns and packages which were returned to sender aren't returned again
+	if t.Returning || t.ParentPackageID != uuid.Nil {
+		return
+	}
+	if !state.chance(state.Returns.Probability) {
+		return
+	}
+
+	ret := &Tracker{
+		PackageID:                     NewPackageID(state.Rand),
+		ParentPackageID:               t.PackageID,
+		Method:                        t.Method,
+		OriginLocationID:              t.DestinationLocationID,
+		DestinationLocationID:         t.OriginLocationID,
+		OriginalDestinationLocationID: t.OriginLocationID,
+
+		State:              enum.Pending,
+		NextTransitionTime: state.Clock.Now().Add(hoursDuration(state.ReturnDelayHours.Rand())),
+	}
+
+	if state.Verbose >= VerboseDebug {
+		log.Printf("ScheduleReturn(%s): return %s in %s",
+			t.PackageID.String()[:8],
+			ret.PackageID.String()[:8],
+			ret.NextTransitionTime.Sub(state.Clock.Now()))
+	}
+
+	state.Trackers.PushTracker(ret)
+}
+
+// TriggerReturnReceived creates the package for a scheduled return
+func TriggerReturnReceived(state *State, t *Tracker) {
+	now := state.Clock.Now()
+
+	parentPackageID := t.ParentPackageID
+	pkg := Package{
+		PackageID:             t.PackageID,
+		SimulatorID:           state.SimulatorID,
+		Received:              now,
+		OriginLocationID:      t.OriginLocationID,
+		DestinationLocationID: t.DestinationLocationID,
+		Method:                t.Method,
+		ParentPackageID:       &parentPackageID,
+	}
+
+	ReceivePackage(state, &pkg, t)
+}
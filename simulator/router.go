@@ -0,0 +1,310 @@
+package simulator
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+
+	"github.com/paulmach/orb/geo"
+	"github.com/pkg/errors"
+
+	"simulator/enum"
+)
+
+const (
+	GreedyStrategy       = "greedy"
+	ShortestPathStrategy = "shortest_path"
+
+	TimeWeight = "time"
+	CostWeight = "cost"
+)
+
+// maxRouteHops bounds the length of a route
+const maxRouteHops = 100
+
+// routeCacheSize bounds the number of routes cached by the shortest path router
+const routeCacheSize = 1 << 20
+
+type RoutingConfig struct {
+	// Strategy selects how packages are routed: greedy (default) or shortest_path
+	Strategy string `yaml:"strategy"`
+
+	// Weight selects what shortest_path minimizes: time (default) or cost
+	Weight string `yaml:"weight"`
+
+	// DirectDistanceKM is the distance within which shortest_path may send
+	// packages directly to their destination (default 1000)
+	DirectDistanceKM float64 `yaml:"direct_distance_km"`
+}
+
+// Router picks the locations a package moves through on the way to it's destination
+type Router interface {
+	// NextLocation returns the next location on the route from current to destination
+	NextLocation(current *Location, destination *Location, method enum.DeliveryMethod) *Location
+
+	// Route returns every location on the route from current to destination
+	// including both ends
+	Route(current *Location, destination *Location, method enum.DeliveryMethod) []*Location
+}
+
+func NewRouter(c *Config, idx *LocationIndex, modes []*TransportModel) (Router, error) {
+	switch c.Routing.Strategy {
+	case "", GreedyStrategy:
+		return idx, nil
+	case ShortestPathStrategy:
+		return NewShortestPathRouter(c.Routing, idx, modes, c.HoursAtRest.Mean())
+	default:
+		return nil, errors.Errorf("unknown routing strategy: %s", c.Routing.Strategy)
+	}
+}
+
+// Route follows NextLocation until it reaches the destination
+func (idx *LocationIndex) Route(current *Location, destination *Location, method enum.DeliveryMethod) []*Location {
+	route := []*Location{current}
+	for current != destination && len(route) <= maxRouteHops {
+		current = idx.NextLocation(current, destination, method)
+		route = append(route, current)
+	}
+	if current != destination {
+		route = append(route, destination)
+	}
+	return route
+}
+
+type routeKey struct {
+	from   int64
+	to     int64
+	method enum.DeliveryMethod
+}
+
+// ShortestPathRouter routes packages along the shortest path through the hub
+// network, where each hub is connected to it's nearest hubs. Packages start by
+// travelling to a hub near their origin and finish from a hub near their
+// destination, unless the destination is close enough to go directly.
+type ShortestPathRouter struct {
+	modes  []*TransportModel
+	weight string
+
+	// hopHours is the time spent at each intermediate location
+	hopHours float64
+
+	directDistance float64
+
+	// hubs contains the neighbors of each hub
+	hubs map[*Location][]*Location
+
+	// heuristic scales the distance to the destination into a lower bound on the remaining weight
+	heuristic float64
+
+	mu    sync.Mutex
+	cache map[routeKey][]*Location
+}
+
+func NewShortestPathRouter(config RoutingConfig, idx *LocationIndex, modes []*TransportModel, hopHours float64) (*ShortestPathRouter, error) {
+	weight := config.Weight
+	if weight == "" {
+		weight = TimeWeight
+	}
+
+	heuristic := math.Inf(1)
+	for _, m := range modes {
+		switch weight {
+		case TimeWeight:
+			heuristic = math.Min(heuristic, 1/m.SpeedKMPH)
+		case CostWeight:
+			heuristic = math.Min(heuristic, m.CostPerKM)
+		default:
+			return nil, errors.Errorf("unknown routing weight: %s", config.Weight)
+		}
+	}
+	if math.IsInf(heuristic, 1) || heuristic < 0 {
+		heuristic = 0
+	}
+
+	directDistance := config.DirectDistanceKM
+	if directDistance == 0 {
+		directDistance = 1000
+	}
+
+	// connect each hub to it's nearest hubs in both directions
+	hubs := make(map[*Location][]*Location)
+	connected := make(map[[2]*Location]struct{})
+	connect := func(a *Location, b *Location) {
+		if _, ok := connected[[2]*Location{a, b}]; !ok {
+			connected[[2]*Location{a, b}] = empty
+			hubs[a] = append(hubs[a], b)
+		}
+	}
+	for _, loc := range idx.popSorted {
+		if loc.Kind != enum.Hub {
+			continue
+		}
+		for _, n := range loc.NearestHubs {
+			connect(loc, n)
+			connect(n, loc)
+		}
+	}
+
+	return &ShortestPathRouter{
+		modes:          modes,
+		weight:         weight,
+		hopHours:       math.Max(hopHours, 0),
+		directDistance: directDistance,
+		hubs:           hubs,
+		heuristic:      heuristic,
+		cache:          make(map[routeKey][]*Location),
+	}, nil
+}
+
+func (r *ShortestPathRouter) NextLocation(current *Location, destination *Location, method enum.DeliveryMethod) *Location {
+	route := r.Route(current, destination, method)
+	if len(route) < 2 {
+		return destination
+	}
+	return route[1]
+}
+
+func (r *ShortestPathRouter) Route(current *Location, destination *Location, method enum.DeliveryMethod) []*Location {
+	key := routeKey{current.LocationID, destination.LocationID, method}
+
+	r.mu.Lock()
+	route, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok {
+		return route
+	}
+
+	route = r.search(current, destination, method)
+
+	r.mu.Lock()
+	if len(r.cache) >= routeCacheSize {
+		r.cache = make(map[routeKey][]*Location)
+	}
+	r.cache[key] = route
+	r.mu.Unlock()
+
+	return route
+}
+
+// edgeWeight returns the weight of travelling directly from a to b
+func (r *ShortestPathRouter) edgeWeight(a *Location, b *Location, destination *Location, method enum.DeliveryMethod) float64 {
+	distance := geo.Distance(a.Position, b.Position) / 1000
+	mode := SelectMode(r.modes, a, b, distance, method)
+	if r.weight == CostWeight {
+		return distance * mode.CostPerKM
+	}
+	hours := distance / mode.SpeedKMPH
+	if b != destination {
+		hours += r.hopHours
+	}
+	return hours
+}
+
+// neighbors returns the locations a package at loc may travel to next
+func (r *ShortestPathRouter) neighbors(loc *Location, destination *Location, final map[*Location]struct{}) []*Location {
+	out := r.hubs[loc]
+	if loc.Kind != enum.Hub {
+		out = loc.NearestHubs
+	}
+
+	_, nearDestination := final[loc]
+	if nearDestination || geo.Distance(loc.Position, destination.Position)/1000 <= r.directDistance {
+		out = append(out[:len(out):len(out)], destination)
+	}
+	return out
+}
+
+// search runs A* from current to destination
+// if the hub network doesn't connect them the package is sent directly
+func (r *ShortestPathRouter) search(current *Location, destination *Location, method enum.DeliveryMethod) []*Location {
+	if current == destination {
+		return []*Location{current}
+	}
+
+	// locations near the destination connect to it
+	final := make(map[*Location]struct{})
+	for _, n := range destination.Nearest {
+		final[n] = empty
+	}
+	for _, n := range destination.NearestHubs {
+		final[n] = empty
+	}
+
+	estimate := func(loc *Location) float64 {
+		return geo.Distance(loc.Position, destination.Position) / 1000 * r.heuristic
+	}
+
+	cost := map[*Location]float64{current: 0}
+	prev := make(map[*Location]*Location)
+	done := make(map[*Location]struct{})
+
+	q := &routeQueue{}
+	heap.Push(q, &routeQueueItem{loc: current, score: estimate(current)})
+
+	for q.Len() > 0 {
+		item := heap.Pop(q).(*routeQueueItem)
+		loc := item.loc
+		if _, ok := done[loc]; ok {
+			continue
+		}
+		done[loc] = empty
+
+		if loc == destination {
+			route := []*Location{}
+			for ; loc != nil; loc = prev[loc] {
+				route = append(route, loc)
+			}
+			for i, j := 0, len(route)-1; i < j; i, j = i+1, j-1 {
+				route[i], route[j] = route[j], route[i]
+			}
+			return route
+		}
+
+		for _, n := range r.neighbors(loc, destination, final) {
+			if _, ok := done[n]; ok {
+				continue
+			}
+			c := cost[loc] + r.edgeWeight(loc, n, destination, method)
+			if existing, ok := cost[n]; !ok || c < existing {
+				cost[n] = c
+				prev[n] = loc
+				heap.Push(q, &routeQueueItem{loc: n, score: c + estimate(n)})
+			}
+		}
+	}
+
+	return []*Location{current, destination}
+}
+
+type routeQueueItem struct {
+	loc   *Location
+	score float64
+}
+
+// routeQueue is a min-heap of locations by score
+// ties are broken by id so routes don't depend on map or slice order
+type routeQueue []*routeQueueItem
+
+func (q routeQueue) Len() int { return len(q) }
+
+func (q routeQueue) Less(i, j int) bool {
+	if q[i].score == q[j].score {
+		return q[i].loc.LocationID < q[j].loc.LocationID
+	}
+	return q[i].score < q[j].score
+}
+
+func (q routeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *routeQueue) Push(x interface{}) {
+	*q = append(*q, x.(*routeQueueItem))
+}
+
+func (q *routeQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[0 : n-1]
+	return item
+}
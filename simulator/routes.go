@@ -0,0 +1,122 @@
+package simulator
+
+import (
+	"log"
+	"time"
+
+	"simulator/enum"
+)
+
+// PlannedHop is a location on a package's planned route
+// PlannedDeparture is zero for the final hop
+type PlannedHop struct {
+	LocationID       int64
+	PlannedArrival   time.Time
+	PlannedDeparture time.Time
+
+	// Mode is the mode of the leg leaving this hop
+	Mode enum.TransportMode
+}
+
+// PlanRoute plans the route of a package received at now
+// each hop is planned to spend the average time at rest, wait for the next
+// scheduled vehicle when shipments are enabled and then travel using the mode
+// selected for the leg
+func PlanRoute(state *State, now time.Time, origin *Location, destination *Location, t *Tracker) []PlannedHop {
+	route := state.Router.Route(origin, destination, t.Method)
+	hops := make([]PlannedHop, len(route))
+
+	arrival := now
+	for i, loc := range route {
+		hops[i] = PlannedHop{
+			LocationID:     loc.LocationID,
+			PlannedArrival: arrival,
+		}
+		if i+1 == len(route) {
+			break
+		}
+
+		mode, duration := state.Transit(loc, route[i+1], t.Method)
+		departure := arrival.Add(hoursDuration(state.HoursAtRest.Mean()))
+		if state.Shipments.Enabled {
+			departure = nextDeparture(departure, mode.Interval)
+		}
+
+		hops[i].PlannedDeparture = departure
+		hops[i].Mode = mode.Mode
+		arrival = departure.Add(duration)
+	}
+
+	return hops
+}
+
+// WriteRoute writes each hop of the tracker's planned route
+func WriteRoute(state *State, t *Tracker) {
+	for i, hop := range t.Route {
+		r := &RouteHop{
+			PackageID:      t.PackageID,
+			Hop:            i,
+			LocationID:     hop.LocationID,
+			PlannedArrival: hop.PlannedArrival,
+		}
+		if !hop.PlannedDeparture.IsZero() {
+			departure := hop.PlannedDeparture
+			r.PlannedDeparture = &departure
+		}
+
+		err := state.Topics.WriteRouteHop(t, r)
+		if err != nil {
+			log.Panicf("failed to write route to topic: %v", err)
+		}
+	}
+}
+
+// plannedNextLocation returns the next location on the tracker's planned
+// route or nil if the package isn't following it's plan
+func plannedNextLocation(state *State, t *Tracker, current *Location) *Location {
+	if t.OffRoute || t.Hop < 0 || t.Hop+1 >= len(t.Route) || t.Route[t.Hop].LocationID != current.LocationID {
+		return nil
+	}
+	next, err := state.Locations.Lookup(t.Route[t.Hop+1].LocationID)
+	if err != nil {
+		log.Panic(err)
+	}
+	return next
+}
+
+// NextLocation returns where the package should go next
+// packages follow their planned route and fall back to the router once they
+// have deviated from it
+func NextLocation(state *State, t *Tracker, current *Location, destination *Location) *Location {
+	if next := plannedNextLocation(state, t, current); next != nil {
+		return next
+	}
+	return state.Router.NextLocation(current, destination, t.Method)
+}
+
+// TrackRoute compares the tracker's arrival at it's current location against
+// it's planned route
+func TrackRoute(state *State, t *Tracker, now time.Time) {
+	if len(t.Route) == 0 || t.OffRoute {
+		return
+	}
+	if t.Hop >= 0 && t.Route[t.Hop].LocationID == t.LastLocationID {
+		// arrived at the same hop again, e.g. after a failed delivery attempt
+		return
+	}
+
+	next := t.Hop + 1
+	if next >= len(t.Route) || t.Route[next].LocationID != t.LastLocationID {
+		if state.Verbose >= VerboseDebug {
+			log.Printf("TrackRoute(%s): deviated from planned route at hop %d",
+				t.PackageID.String()[:8], next)
+		}
+
+		t.OffRoute = true
+		routeDeviations.Inc()
+		return
+	}
+
+	t.Hop = next
+	routeArrivalDelay.Observe(now.Sub(t.Route[next].PlannedArrival).Hours())
+}
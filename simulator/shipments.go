@@ -0,0 +1,147 @@
+package simulator
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"simulator/enum"
+)
+
+type ShipmentsConfig struct {
+	// Enabled batches packages bound for the same next location onto scheduled vehicles
+	// the schedule and capacity of vehicles is configured per mode
+	Enabled bool `yaml:"enabled"`
+
+	// Vehicles is the legacy schedule and capacity of vehicles for each mode
+	// it's only used for modes which don't set their own interval or capacity
+	Vehicles map[enum.TransportMode]VehicleConfig `yaml:"vehicles"`
+}
+
+// VehicleConfig is replaced by ModeConfig.Interval and ModeConfig.Capacity
+type VehicleConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Capacity int           `yaml:"capacity"`
+}
+
+// Lane is a connection between two locations served by a single mode
+type Lane struct {
+	From int64
+	To   int64
+	Mode enum.TransportMode
+}
+
+// LaneSchedule tracks the vehicle currently being loaded on a lane
+type LaneSchedule struct {
+	ShipmentID uuid.UUID
+	Vehicles   int
+}
+
+type Shipment struct {
+	ShipmentID            uuid.UUID
+	VehicleID             string
+	Mode                  enum.TransportMode
+	OriginLocationID      int64
+	DestinationLocationID int64
+	Departure             time.Time
+	Arrival               time.Time
+	PackageIDs            []uuid.UUID
+}
+
+// nextDeparture returns the first departure on a schedule with the given interval after t
+func nextDeparture(t time.Time, interval time.Duration) time.Time {
+	if interval <= 0 {
+		return t
+	}
+	next := t.Truncate(interval)
+	if next.Before(t) {
+		next = next.Add(interval)
+	}
+	return next
+}
+
+// BoardShipment loads the tracker onto the next vehicle leaving for it's next
+// location. The tracker will depart when the vehicle does.
+func BoardShipment(state *State, t *Tracker) {
+	currentLocation, err := state.Locations.Lookup(t.LastLocationID)
+	if err != nil {
+		log.Panic(err)
+	}
+	destinationLocation, err := state.Locations.Lookup(t.DestinationLocationID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	nextLocation := NextLocation(state, t, currentLocation, destinationLocation)
+	nextLocation = Misroute(state, t, currentLocation, nextLocation)
+	vehicle, _ := state.Transit(currentLocation, nextLocation, t.Method)
+
+	mode := vehicle.Mode
+	lane := Lane{From: currentLocation.LocationID, To: nextLocation.LocationID, Mode: mode}
+	ready := t.NextTransitionTime
+
+	schedule, ok := state.Lanes[lane]
+	if !ok {
+		schedule = &LaneSchedule{}
+		state.Lanes[lane] = schedule
+	}
+
+	// board the vehicle currently loading if it has room and hasn't left yet
+	shipment := state.PendingShipments[schedule.ShipmentID]
+	if shipment == nil || !shipment.Departure.After(ready) ||
+		(vehicle.Capacity > 0 && len(shipment.PackageIDs) >= vehicle.Capacity) {
+
+		departure := nextDeparture(ready, vehicle.Interval)
+		if shipment != nil && !departure.After(shipment.Departure) {
+			// the previous vehicle is full, so wait for the one after
+			departure = shipment.Departure.Add(vehicle.Interval)
+		}
+
+		// each worker schedules it's own vehicles so the id includes the
+		// simulator and worker to keep it unique
+		schedule.Vehicles++
+		shipment = &Shipment{
+			ShipmentID:            NewPackageID(state.Rand),
+			VehicleID:             fmt.Sprintf("%s-%d-%s-%d-%d-%d", state.SimulatorID, state.Worker, mode, lane.From, lane.To, schedule.Vehicles),
+			Mode:                  mode,
+			OriginLocationID:      lane.From,
+			DestinationLocationID: lane.To,
+			Departure:             departure,
+			Arrival:               departure.Add(state.LegDuration(vehicle, currentLocation, nextLocation)),
+			PackageIDs:            make([]uuid.UUID, 0),
+		}
+		schedule.ShipmentID = shipment.ShipmentID
+		state.PendingShipments[shipment.ShipmentID] = shipment
+	}
+
+	shipment.PackageIDs = append(shipment.PackageIDs, t.PackageID)
+
+	t.ShipmentID = shipment.ShipmentID
+	t.NextLocationID = nextLocation.LocationID
+	t.NextTransitionTime = shipment.Departure
+	t.LegDuration = shipment.Arrival.Sub(shipment.Departure)
+
+	if state.Verbose >= VerboseDebug {
+		log.Printf("BoardShipment(%s): %s departing in %s",
+			t.PackageID.String()[:8],
+			shipment.VehicleID,
+			shipment.Departure.Sub(ready))
+	}
+}
+
+// DepartShipment writes the shipment the first time one of it's packages departs
+func DepartShipment(state *State, shipmentID uuid.UUID) {
+	shipment, ok := state.PendingShipments[shipmentID]
+	if !ok {
+		// already departed
+		return
+	}
+	delete(state.PendingShipments, shipmentID)
+
+	err := state.Topics.WriteShipment(shipment)
+	if err != nil {
+		log.Panicf("failed to write shipment to topic: %v", err)
+	}
+}
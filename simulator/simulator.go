@@ -2,15 +2,14 @@ package simulator
 
 import (
 	"log"
-	"math"
 	"math/rand"
 	"simulator/enum"
 	"time"
 
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geo"
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
-	"gonum.org/v1/gonum/stat/distuv"
 )
 
 const (
@@ -20,112 +19,235 @@ const (
 	VerboseSilly  = 3
 )
 
+// World contains the read-only inputs shared by every worker
+type World struct {
+	Locations *LocationIndex
+	Demand    DemandModel
+
+	// Gravity is nil when the gravity model is disabled
+	Gravity *GravityModel
+
+	Modes  []*TransportModel
+	Router Router
+
+	// Partition is nil unless this simulator is responsible for a single region
+	Partition *Partition
+
+	// SchemaIDs contains the registered schema id of each topic
+	// it's empty unless a schema registry is configured
+	SchemaIDs map[string]int
+}
+
 type State struct {
 	Clock     *Clock
 	Trackers  Trackers
 	Locations *LocationIndex
+	Demand    DemandModel
+	Gravity   *GravityModel
+	Modes     []*TransportModel
+	Router    Router
+	Partition *Partition
+	Estimator *Estimator
 	Topics    *Topics
+	Rand      *rand.Rand
 
 	// CloseCh should be closed to stop the Simulation
 	CloseCh chan struct{}
 
+	// Handoffs receives packages handed off to this simulator's region
+	// handoffs contains the handoffs accepted since the last checkpoint
+	Handoffs <-chan *Tracker
+	handoffs []*handoffOffset
+
+	// HandoffConsumer is set instead of Handoffs when the worker consumes
+	// it's share of the handoffs in it's own transactions
+	HandoffConsumer Consumer
+	nextHandoffPoll time.Time
+
+	TotalDelivered int
+
+	// Queues tracks the processing backlog at each location
+	Queues        map[int64]*HubQueue
+	CapacityShare float64
+	PriorityQueue bool
+
+	// PendingShipments contains shipments which haven't departed yet
+	// Lanes tracks the shipment currently being loaded on each lane
+	Shipments        ShipmentsConfig
+	PendingShipments map[uuid.UUID]*Shipment
+	Lanes            map[Lane]*LaneSchedule
+
+	// CheckpointPath is where the worker's checkpoint is written; empty disables checkpoints
+	CheckpointPath     string
+	CheckpointInterval time.Duration
+	nextCheckpoint     time.Time
+	checkpointSeq      int64
+
 	SimulatorID string
+	Worker      int
 	SimInterval time.Duration
+	TimeScale   float64
 	Verbose     int
 
-	MaxPackages             int
-	MaxDelivered            int
-	PackagesPerTick         *distuv.Normal
-	HoursAtRest             *distuv.Normal
-	ProbabilityExpress      float64
-	MinShippingDistanceKM   float64
-	MinAirFreightDistanceKM float64
-	AvgLandSpeedKMPH        float64
-	AvgAirSpeedKMPH         float64
+	MaxPackages           int
+	MaxDelivered          int
+	PackagesPerTick       Sampler
+	HoursAtRest           Sampler
+	Arrivals              Arrivals
+	Exceptions            ExceptionsConfig
+	ExceptionRates        ExceptionRates
+	exceptionSamplers     exceptionSamplers
+	speeds                map[enum.TransportMode]Sampler
+	DelayHours            Sampler
+	DamagedHours          Sampler
+	Returns               ReturnsConfig
+	ReturnDelayHours      Sampler
+	ProbabilityExpress    float64
+	MinShippingDistanceKM float64
 }
 
-func NewState(c *Config, locations *LocationIndex, producer Producer, trackers Trackers) *State {
+// NewState creates the state for a single worker
+// each worker gets its own random source derived from the simulator id, the
+// configured seed and the worker
+func NewState(c *Config, worker int, world *World, producer Producer, trackers Trackers) *State {
+	rng := rand.New(rand.NewSource(workerSeed(c.SimulatorID, c.Seed, worker)))
+
+	checkpointPath := ""
+	if c.Checkpoint.Dir != "" {
+		checkpointPath = CheckpointPath(c.Checkpoint.Dir, c.SimulatorID, worker)
+	}
+
+	speeds := make(map[enum.TransportMode]Sampler, len(world.Modes))
+	for _, m := range world.Modes {
+		speeds[m.Mode] = m.Speed.ToDist(rng)
+	}
+
 	return &State{
 		Clock:     NewClock(c.StartTime),
 		Trackers:  trackers,
-		Locations: locations,
-		Topics:    NewTopics(producer),
+		Locations: world.Locations,
+		Demand:    world.Demand,
+		Gravity:   world.Gravity,
+		Modes:     world.Modes,
+		Router:    world.Router,
+		Partition: world.Partition,
+		Estimator: NewEstimator(c.Estimate),
+		Topics:    NewTopics(producer, world.SchemaIDs, NewRecordKeys(c.Topics.Partitioner, c.SimulatorID, world)),
+		Rand:      rng,
 
 		CloseCh: make(chan struct{}),
 
+		Queues:        make(map[int64]*HubQueue),
+		CapacityShare: 1 / float64(c.Workers()),
+		PriorityQueue: c.Capacity.Queue == PriorityQueue,
+
+		Shipments:        c.Shipments,
+		PendingShipments: make(map[uuid.UUID]*Shipment),
+		Lanes:            make(map[Lane]*LaneSchedule),
+
+		CheckpointPath:     checkpointPath,
+		CheckpointInterval: c.Checkpoint.Interval,
+		nextCheckpoint:     c.StartTime.Add(c.Checkpoint.Interval),
+
 		SimulatorID: c.SimulatorID,
+		Worker:      worker,
 		SimInterval: c.SimInterval,
+		TimeScale:   c.TimeScale,
 		Verbose:     c.Verbose,
 
-		MaxPackages:             c.MaxPackages,
-		MaxDelivered:            c.MaxDelivered,
-		PackagesPerTick:         c.PackagesPerTick.ToDist(),
-		HoursAtRest:             c.HoursAtRest.ToDist(),
-		ProbabilityExpress:      c.ProbabilityExpress,
-		MinShippingDistanceKM:   c.MinShippingDistanceKM,
-		MinAirFreightDistanceKM: c.MinAirFreightDistanceKM,
-		AvgLandSpeedKMPH:        c.AvgLandSpeedKMPH,
-		AvgAirSpeedKMPH:         c.AvgAirSpeedKMPH,
+		MaxPackages:           c.MaxPackages,
+		MaxDelivered:          c.MaxDelivered,
+		PackagesPerTick:       c.PackagesPerTick.ToDist(rng),
+		HoursAtRest:           c.HoursAtRest.ToDist(rng),
+		Exceptions:            c.Exceptions,
+		exceptionSamplers:     newExceptionSamplers(c.Exceptions, rng),
+		speeds:                speeds,
+		DelayHours:            c.Exceptions.DelayHours.ToDist(rng),
+		DamagedHours:          c.Exceptions.DamagedHours.ToDist(rng),
+		Returns:               c.Returns,
+		ReturnDelayHours:      c.Returns.DelayHours.ToDist(rng),
+		ProbabilityExpress:    c.ProbabilityExpress,
+		MinShippingDistanceKM: c.MinShippingDistanceKM,
 	}
 }
 
 func Simulate(state *State) {
-	totalDelivered := 0
-	for {
-		now := state.Clock.Now()
+	// take a final checkpoint on exit so a restored run resumes exactly here
+	defer checkpoint(state)
 
-		if state.Verbose >= VerboseInfo {
-			log.Printf("TICK: %s tracked(%d) delivered(%d/%d)", now, state.Trackers.Len(), totalDelivered, state.MaxDelivered)
+	state.Clock.RealTime(state.TimeScale)
+
+	if state.Arrivals.Next.IsZero() {
+		state.scheduleArrival(state.Clock.Now())
+	}
+
+	// an aborted transaction resumes from the last committed checkpoint, so
+	// there has to be one before any handoffs are consumed
+	if state.HandoffConsumer != nil {
+		for state.checkpointSeq == 0 {
+			checkpoint(state)
 		}
+	}
+	nextTick := state.Clock.Now()
 
-		if state.MaxPackages <= 0 || state.Trackers.Len() < state.MaxPackages {
-			numNewPackages := state.PackagesPerTick.Rand()
-			if state.MaxPackages > 0 {
-				numNewPackages = math.Min(
-					float64(state.MaxPackages-state.Trackers.Len()),
-					numNewPackages,
-				)
-			}
-			CreatePackages(state, now, int(numNewPackages))
+	for {
+		AcceptHandoffs(state)
+
+		// the next event is either the earliest tracker transition or the next
+		// package arrival
+		next := state.Arrivals.Next
+		arrival := true
+		if state.Trackers.Len() > 0 && state.Trackers.EarliestTransitionTime().Before(next) {
+			next = state.Trackers.EarliestTransitionTime()
+			arrival = false
 		}
 
-		// process up to an hour of transitions
-		processEnd := now.Add(time.Hour)
+		if state.CheckpointInterval > 0 && !next.Before(state.nextCheckpoint) {
+			state.Clock.Set(state.nextCheckpoint)
+			checkpoint(state)
+			state.nextCheckpoint = state.nextCheckpoint.Add(state.CheckpointInterval)
+			continue
+		}
 
-		for state.Trackers.Len() > 0 && state.Trackers.EarliestTransitionTime().Before(processEnd) {
-			tracker := state.Trackers.PopTracker()
+		if !state.Clock.WaitUntil(next, state.CloseCh) {
+			return
+		}
 
-			switch tracker.State {
-			case enum.AtRest:
-				TriggerDepartureScan(state, tracker)
-				state.Trackers.PushTracker(tracker)
+		// events may have been scheduled before the clock, e.g. packages loaded from the database
+		if next.After(state.Clock.Now()) {
+			state.Clock.Set(next)
+		}
+		now := state.Clock.Now()
 
-			case enum.InTransit:
-				// the package has reached it's current destination
-				if tracker.DestinationLocationID == tracker.NextLocationID {
-					// the package has reached it's final destination
-					// don't put it back in state.Trackers
-					TriggerDelivered(state, tracker)
-					totalDelivered++
-				} else {
-					// the package has reached a interim destination
-					TriggerArrivalScan(state, tracker)
-					state.Trackers.PushTracker(tracker)
+		if !now.Before(nextTick) {
+			if state.Verbose >= VerboseInfo {
+				log.Printf("TICK: %s tracked(%d) delivered(%d/%d)", now, state.Trackers.Len(), state.TotalDelivered, state.MaxDelivered)
+			}
+			if state.SimInterval > 0 && !state.Clock.IsRealTime() {
+				time.Sleep(state.SimInterval)
+			}
+			if state.Partition != nil {
+				// make handoffs visible to the other regions
+				err := state.Topics.Flush()
+				if err != nil {
+					log.Panicf("failed to flush topics: %v", err)
 				}
-
-			default:
-				log.Panicf("unknown state %+v for package %s", tracker.State, tracker.PackageID)
 			}
+			nextTick = now.Truncate(time.Hour).Add(time.Hour)
 		}
 
-		// advance the clock
-		if state.Trackers.Len() > 0 {
-			state.Clock.Set(state.Trackers.EarliestTransitionTime())
+		state.updateExceptionRates(now)
+
+		if arrival {
+			if state.Arrivals.Arrival {
+				CreatePackages(state, now, 1)
+			}
+			state.scheduleArrival(now)
 		} else {
-			state.Clock.Tick(time.Hour)
+			ProcessTransition(state, state.Trackers.PopTracker())
 		}
 
-		if state.MaxDelivered > 0 && totalDelivered >= state.MaxDelivered {
+		if state.MaxDelivered > 0 && state.TotalDelivered >= state.MaxDelivered {
 			return
 		}
 
@@ -134,24 +256,132 @@ func Simulate(state *State) {
 			return
 		default:
 		}
+	}
+}
 
-		if state.SimInterval > 0 {
-			time.Sleep(state.SimInterval)
+// ProcessTransition moves the tracker into it's next state
+func ProcessTransition(state *State, tracker *Tracker) {
+	if HandOff(state, tracker) {
+		// the package was restored by this simulator but belongs to another region
+		return
+	}
+
+	switch tracker.State {
+	case enum.AtRest:
+		switch {
+		case tracker.ShipmentID != uuid.Nil:
+			// the package's vehicle is departing
+			TriggerDepartureScan(state, tracker)
+		case !ReserveProcessing(state, tracker):
+			// wait for the location to have capacity to process the package
+		case state.Shipments.Enabled:
+			BoardShipment(state, tracker)
+		default:
+			TriggerDepartureScan(state, tracker)
+		}
+		if tracker.State == enum.InTransit && HandOff(state, tracker) {
+			// the region the package is travelling to tracks it from now on
+			return
+		}
+		state.Trackers.PushTracker(tracker)
+
+	case enum.InTransit:
+		// packages waiting at their destination for another delivery attempt
+		// aren't travelling so they can't be lost
+		atDestination := tracker.LastLocationID == tracker.DestinationLocationID
+		if !atDestination && state.chance(state.ExceptionRates.Lost) {
+			// the package never arrives
+			// don't put it back in state.Trackers
+			TriggerLost(state, tracker)
+		} else if tracker.DestinationLocationID == tracker.NextLocationID {
+			// the package has reached it's final destination
+			// packages being returned to sender are always accepted
+			if !tracker.Returning && state.chance(state.ExceptionRates.DeliveryAttemptFailed) {
+				TriggerDeliveryAttemptFailed(state, tracker)
+				state.Trackers.PushTracker(tracker)
+			} else {
+				// don't put it back in state.Trackers
+				TriggerDelivered(state, tracker)
+				ScheduleReturn(state, tracker)
+				state.TotalDelivered++
+			}
+		} else {
+			// the package has reached a interim destination
+			TriggerArrivalScan(state, tracker)
+			TriggerArrivalExceptions(state, tracker)
+			state.Trackers.PushTracker(tracker)
 		}
+
+	case enum.Pending:
+		// a return is handed in
+		TriggerReturnReceived(state, tracker)
+		state.Trackers.PushTracker(tracker)
+
+	default:
+		log.Panicf("unknown state %+v for package %s", tracker.State, tracker.PackageID)
+	}
+}
+
+func checkpoint(state *State) {
+	if state.CheckpointPath == "" {
+		return
+	}
+	err := WriteCheckpoint(state)
+	if errors.Cause(err) == ErrTransactionAborted {
+		// the handoffs consumed since the last commit will be consumed again,
+		// maybe by another worker, so the worker has to forget them too
+		log.Printf("worker %d: %v; resuming from the last commit", state.Worker, err)
+		err = RestoreLastCommit(state)
+	}
+	if err != nil {
+		log.Panicf("failed to write checkpoint: %+v", err)
+	}
+	if state.Verbose >= VerboseInfo {
+		log.Printf("CHECKPOINT: %s tracked(%d) -> %s", state.Clock.Now(), state.Trackers.Len(), state.CheckpointPath)
 	}
 }
 
 func CreatePackages(state *State, now time.Time, numNewPackages int) {
-	// create new packages
 	for i := 0; i < numNewPackages; i++ {
-		method := enum.Standard
-		if rand.Float64() > state.ProbabilityExpress {
-			method = enum.Express
+		origin, err := randOrigin(state)
+		if err != nil {
+			log.Panicf("failed to pick origin: %+v", err)
+		}
+
+		// the demand model decides how many packages this origin actually receives
+		n := stochasticRound(state.Rand, state.Demand.Demand(now, origin))
+		for j := 0; j < n; j++ {
+			if state.MaxPackages > 0 && state.Trackers.Len() >= state.MaxPackages {
+				return
+			}
+			CreatePackage(state, now, origin)
 		}
+	}
+}
 
-		origin := state.Locations.Rand(nil)
+// randOrigin picks where a new package is received
+// partitioned simulators only receive packages in their own region
+func randOrigin(state *State) (*Location, error) {
+	if state.Partition != nil {
+		return state.Partition.Rand(state.Rand), nil
+	}
+	return state.Locations.Rand(state.Rand, nil)
+}
+
+func CreatePackage(state *State, now time.Time, origin *Location) {
+	method := enum.Standard
+	if state.Rand.Float64() > state.ProbabilityExpress {
+		method = enum.Express
+	}
 
-		destination := state.Locations.Rand(func(p orb.Pointer) bool {
+	var (
+		destination *Location
+		err         error
+	)
+	if state.Gravity != nil {
+		destination, err = state.Gravity.Destination(state.Rand, origin, state.MinShippingDistanceKM)
+	} else {
+		destination, err = state.Locations.Rand(state.Rand, func(p orb.Pointer) bool {
 			candidate := p.(*Location)
 			if candidate == origin {
 				return false
@@ -159,59 +389,102 @@ func CreatePackages(state *State, now time.Time, numNewPackages int) {
 			// we only deliver packages which travel farther than MinShippingDistanceKM
 			return geo.Distance(origin.Position, candidate.Position)/1000 > state.MinShippingDistanceKM
 		})
-
-		// extremely crude delivery estimate calculation
-		distance := geo.Distance(origin.Position, destination.Position) / 1000
-		avgSpeed := state.AvgLandSpeedKMPH
-		if method == enum.Express {
-			avgSpeed = state.AvgAirSpeedKMPH
-		}
-		// include an overhead buffer of 20% due to processing delays per transit point
-		hours := (distance / avgSpeed) * 1.2
-		deliveryEstimate := now.Add(time.Duration(hours) * time.Hour)
-
-		pkg := Package{
-			PackageID:             uuid.NewV4(),
-			SimulatorID:           state.SimulatorID,
-			Received:              now,
-			OriginLocationID:      origin.LocationID,
-			DestinationLocationID: destination.LocationID,
-			DeliveryEstimate:      deliveryEstimate,
-			Method:                method,
+	}
+	if err != nil {
+		// there may not be any destination far enough away from this origin
+		packagesSkipped.Inc()
+		if state.Verbose >= VerboseDebug {
+			log.Printf("CreatePackage: skipping package from %s: %v", PointString(origin.Position), err)
 		}
+		return
+	}
 
-		err := state.Topics.WritePackage(&pkg)
-		if err != nil {
-			log.Panicf("failed to write package to topic: %v", err)
-		}
+	pkg := Package{
+		PackageID:             NewPackageID(state.Rand),
+		SimulatorID:           state.SimulatorID,
+		Received:              now,
+		OriginLocationID:      origin.LocationID,
+		DestinationLocationID: destination.LocationID,
+		Method:                method,
+	}
 
-		nextTransitionTime := now.Add(time.Hour * time.Duration(state.HoursAtRest.Rand()))
+	t := &Tracker{
+		PackageID:                     pkg.PackageID,
+		Method:                        pkg.Method,
+		OriginLocationID:              pkg.OriginLocationID,
+		DestinationLocationID:         pkg.DestinationLocationID,
+		OriginalDestinationLocationID: pkg.DestinationLocationID,
 
-		t := &Tracker{
-			PackageID:             pkg.PackageID,
-			Method:                pkg.Method,
-			DestinationLocationID: pkg.DestinationLocationID,
+		NextTransitionTime: now.Add(hoursDuration(state.HoursAtRest.Rand())),
+	}
 
-			State:          enum.InTransit,
-			Seq:            0,
-			LastLocationID: pkg.OriginLocationID,
-			NextLocationID: pkg.OriginLocationID,
+	ReceivePackage(state, &pkg, t)
+	state.Trackers.PushTracker(t)
+}
 
-			NextTransitionTime: nextTransitionTime,
-		}
+// ReceivePackage plans the package's route, estimates it's delivery, writes
+// the package and records it's arrival at the origin
+func ReceivePackage(state *State, pkg *Package, t *Tracker) {
+	origin, err := state.Locations.Lookup(pkg.OriginLocationID)
+	if err != nil {
+		log.Panic(err)
+	}
+	destination, err := state.Locations.Lookup(pkg.DestinationLocationID)
+	if err != nil {
+		log.Panic(err)
+	}
 
-		if state.Verbose >= VerboseDebug {
-			log.Printf("CreatePackage(%s): %s -> %s (%s, %.1fkm)",
-				pkg.PackageID.String()[:8],
-				PointString(origin.Position),
-				PointString(destination.Position),
-				method, distance)
-		}
+	// the arrival scan at the origin reaches the first hop
+	t.Route = PlanRoute(state, pkg.Received, origin, destination, t)
+	t.Hop = -1
+
+	t.Received = pkg.Received
+	t.PlannedTransit = state.Estimator.PlannedTransit(pkg.Received, t.Route)
+	t.DeliveryEstimate = state.Estimator.Estimate(pkg.Received, origin, pkg.Method, t.PlannedTransit)
+	pkg.DeliveryEstimate = t.DeliveryEstimate
 
-		TriggerArrivalScan(state, t)
-		state.Trackers.PushTracker(t)
+	err = state.Topics.WritePackage(pkg)
+	if err != nil {
+		log.Panicf("failed to write package to topic: %v", err)
 	}
+	WriteRoute(state, t)
+
+	t.State = enum.InTransit
+	t.Seq = 0
+	t.LastLocationID = pkg.OriginLocationID
+	t.NextLocationID = pkg.OriginLocationID
+
+	if state.Verbose >= VerboseDebug {
+		log.Printf("CreatePackage(%s): %s -> %s (%s, %.1fkm)",
+			pkg.PackageID.String()[:8],
+			PointString(origin.Position),
+			PointString(destination.Position),
+			pkg.Method,
+			geo.Distance(origin.Position, destination.Position)/1000)
+	}
+
+	TriggerArrivalScan(state, t)
+}
+
+// Transit returns the mode and planned duration of travel between two locations
+// the planned duration uses the mode's mean speed
+func (s *State) Transit(from *Location, to *Location, method enum.DeliveryMethod) (*TransportModel, time.Duration) {
+	return transit(s.Modes, from, to, method)
+}
 
+func transit(modes []*TransportModel, from *Location, to *Location, method enum.DeliveryMethod) (*TransportModel, time.Duration) {
+	distance := geo.Distance(from.Position, to.Position) / 1000
+	mode := SelectMode(modes, from, to, distance, method)
+	return mode, hoursDuration(distance / mode.SpeedKMPH)
+}
+
+// LegDuration draws the duration of a leg between two locations using the given mode
+func (s *State) LegDuration(mode *TransportModel, from *Location, to *Location) time.Duration {
+	speed := s.speeds[mode.Mode].Rand()
+	if speed <= 0 {
+		speed = mode.SpeedKMPH
+	}
+	return hoursDuration(geo.Distance(from.Position, to.Position) / 1000 / speed)
 }
 
 func TriggerDepartureScan(state *State, t *Tracker) {
@@ -224,29 +497,44 @@ func TriggerDepartureScan(state *State, t *Tracker) {
 		log.Panic(err)
 	}
 
-	nextLocation := state.Locations.NextLocation(currentLocation, destinationLocation, t.Method)
-
-	distanceToNext := geo.Distance(currentLocation.Position, nextLocation.Position) / 1000
-	speed := state.AvgLandSpeedKMPH
-	if distanceToNext > state.MinAirFreightDistanceKM {
-		speed = state.AvgAirSpeedKMPH
+	var nextLocation *Location
+	var mode *TransportModel
+	var duration time.Duration
+	if t.ShipmentID != uuid.Nil {
+		// the next location and duration were picked when the package boarded it's shipment
+		nextLocation, err = state.Locations.Lookup(t.NextLocationID)
+		if err != nil {
+			log.Panic(err)
+		}
+		mode, _ = state.Transit(currentLocation, nextLocation, t.Method)
+		duration = t.LegDuration
+		DepartShipment(state, t.ShipmentID)
+		t.ShipmentID = uuid.Nil
+	} else {
+		nextLocation = NextLocation(state, t, currentLocation, destinationLocation)
+		nextLocation = Misroute(state, t, currentLocation, nextLocation)
+		mode, _ = state.Transit(currentLocation, nextLocation, t.Method)
+		duration = state.LegDuration(mode, currentLocation, nextLocation)
 	}
 
-	duration := time.Hour * time.Duration(distanceToNext/speed)
+	distanceToNext := geo.Distance(currentLocation.Position, nextLocation.Position) / 1000
 	nextTransitionTime := state.Clock.Now().Add(duration)
 
 	t.State = enum.InTransit
 	t.Seq = t.Seq + 1
 	t.LastLocationID = currentLocation.LocationID
+	t.LastTransitionTime = state.Clock.Now()
 
 	t.NextTransitionTime = nextTransitionTime
 	t.NextLocationID = nextLocation.LocationID
+	t.Mode = mode.Mode
 
 	if state.Verbose >= VerboseDebug {
-		log.Printf("DepartureScan(%s): %s -> %s in %s (%.1fkm)",
+		log.Printf("DepartureScan(%s): %s -> %s by %s in %s (%.1fkm)",
 			t.PackageID.String()[:8],
 			PointString(currentLocation.Position),
 			PointString(nextLocation.Position),
+			t.Mode,
 			t.NextTransitionTime.Sub(state.Clock.Now()),
 			distanceToNext)
 	}
@@ -263,7 +551,10 @@ func TriggerArrivalScan(state *State, t *Tracker) {
 	t.LastLocationID = t.NextLocationID
 
 	now := state.Clock.Now()
-	t.NextTransitionTime = now.Add(time.Hour * time.Duration(state.HoursAtRest.Rand()))
+	t.LastTransitionTime = now
+	t.NextTransitionTime = now.Add(hoursDuration(state.HoursAtRest.Rand()))
+
+	TrackRoute(state, t, now)
 
 	if state.Verbose >= VerboseDebug {
 		currentLocation, err := state.Locations.Lookup(t.LastLocationID)
@@ -289,6 +580,9 @@ func TriggerDelivered(state *State, t *Tracker) {
 	t.Seq = t.Seq + 1
 	t.LastLocationID = t.NextLocationID
 
+	TrackRoute(state, t, state.Clock.Now())
+	state.Estimator.Observe(t, state.Clock.Now())
+
 	if state.Verbose >= VerboseDebug {
 		currentLocation, err := state.Locations.Lookup(t.LastLocationID)
 		if err != nil {
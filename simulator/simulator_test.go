@@ -0,0 +1,200 @@
+package simulator
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"simulator/enum"
+)
+
+const testConfig = `
+id: test
+seed: 1
+start_time: "2021-01-01T00:00:00Z"
+num_workers: 1
+max_packages: 200
+max_delivered: 50
+packages_per_tick: 500
+hours_at_rest: { type: lognormal, avg: 3, stddev: 1 }
+probability_express: 0.4
+min_shipping_distance_km: 1000
+min_air_freight_distance_km: 2000
+avg_land_speed_kmph: 50
+avg_air_speed_kmph: 750
+exceptions:
+  delay: 0.05
+  delay_hours: { type: gamma, avg: 12, stddev: 6 }
+returns:
+  probability: 0.2
+  delay_hours: { avg: 24, stddev: 6 }
+topics:
+  backend: memory
+`
+
+// testWorld builds a world from a grid of locations spanning several
+// thousand kilometers, every other one a hub
+func testWorld(t *testing.T, config *Config) *World {
+	t.Helper()
+
+	locations := make([]DBLocation, 0)
+	id := int64(1)
+	for lng := -20.0; lng <= 40; lng += 5 {
+		for lat := 30.0; lat <= 60; lat += 5 {
+			kind := enum.Point
+			if id%2 == 0 {
+				kind = enum.Hub
+			}
+			locations = append(locations, DBLocation{
+				LocationID: id,
+				Kind:       kind,
+				Country:    "Test",
+				Longitude:  lng,
+				Latitude:   lat,
+				Population: int(id) * 10000,
+			})
+			id++
+		}
+	}
+
+	index, err := NewLocationIndexFromDB(locations, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	demand, err := NewDemandModel(config.Demand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes, err := NewTransportModels(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config, index, modes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &World{
+		Locations: index,
+		Demand:    demand,
+		Modes:     modes,
+		Router:    router,
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfigs([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	producer := NewMemoryProducer()
+	state := NewState(config, 0, testWorld(t, config), producer, Trackers{})
+	Simulate(state)
+
+	if state.TotalDelivered < config.MaxDelivered {
+		t.Fatalf("expected %d packages to be delivered, got %d", config.MaxDelivered, state.TotalDelivered)
+	}
+
+	packages := make(map[uuid.UUID]*Package)
+	for _, d := range producer.Records("packages") {
+		var p Package
+		if err := decodeRecord(nil, "packages", d, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.SimulatorID != config.SimulatorID || p.OriginLocationID == p.DestinationLocationID ||
+			p.Received.Before(config.StartTime) || !p.DeliveryEstimate.After(p.Received) {
+			t.Errorf("unexpected package %+v", p)
+		}
+		packages[p.PackageID] = &p
+	}
+	if len(packages) == 0 {
+		t.Fatal("expected packages to be written")
+	}
+
+	// each package's transitions are written in order
+	lastSeq := make(map[uuid.UUID]int)
+	kinds := make(map[enum.TransitionKind]int)
+	for _, d := range producer.Records("transitions") {
+		var tr struct {
+			PackageID      uuid.UUID
+			Seq            int
+			LocationID     int64
+			NextLocationID *int64
+			Recorded       time.Time
+			Kind           enum.TransitionKind
+			Mode           *enum.TransportMode
+		}
+		if err := decodeRecord(nil, "transitions", d, &tr); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := packages[tr.PackageID]; !ok {
+			t.Errorf("transition of unknown package %s", tr.PackageID)
+		}
+		if seq, ok := lastSeq[tr.PackageID]; ok && tr.Seq <= seq {
+			t.Errorf("package %s: transition %d written after %d", tr.PackageID, tr.Seq, seq)
+		}
+		lastSeq[tr.PackageID] = tr.Seq
+		kinds[tr.Kind]++
+	}
+	if kinds[enum.Delivered] < config.MaxDelivered {
+		t.Errorf("expected at least %d delivered transitions, got %v", config.MaxDelivered, kinds)
+	}
+	if kinds[enum.DepartureScan] == 0 || kinds[enum.ArrivalScan] == 0 {
+		t.Errorf("expected departure and arrival scans, got %v", kinds)
+	}
+}
+
+func TestLostExcludesPackagesAtDestination(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfigs([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer := NewMemoryProducer()
+	state := NewState(config, 0, testWorld(t, config), producer, Trackers{})
+	state.ExceptionRates = ExceptionRates{Day: config.StartTime, Lost: 1}
+
+	// the package is waiting at it's destination after a failed delivery attempt
+	tracker := &Tracker{
+		PackageID:             uuid.NewV4(),
+		Method:                enum.Standard,
+		OriginLocationID:      1,
+		DestinationLocationID: 2,
+		State:                 enum.InTransit,
+		Seq:                   3,
+		LastLocationID:        2,
+		NextLocationID:        2,
+		DeliveryAttempts:      1,
+		NextTransitionTime:    config.StartTime,
+	}
+	ProcessTransition(state, tracker)
+
+	if !tracker.Delivered {
+		t.Fatal("expected the package to be delivered")
+	}
+	for _, d := range producer.Records("transitions") {
+		var tr struct {
+			Kind enum.TransitionKind
+		}
+		if err := decodeRecord(nil, "transitions", d, &tr); err != nil {
+			t.Fatal(err)
+		}
+		if tr.Kind == enum.Lost {
+			t.Fatal("a package at it's destination was lost")
+		}
+	}
+}
@@ -2,9 +2,12 @@ package simulator
 
 import (
 	"simulator/enum"
+	"simulator/registry"
+	"sort"
 	"time"
 
 	"github.com/hamba/avro"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -21,7 +24,8 @@ var (
 				{ "name": "DestinationLocationID", "type": "long" },
 				{ "name": "Method", "type": { "name": "Method", "type": "enum", "symbols": [
 					"standard", "express"
-				] } }
+				] } },
+				{ "name": "ParentPackageID", "type": ["null", { "type": "string", "logicalType": "uuid" }], "default": null }
 			]
 		}
 	`)
@@ -37,40 +41,343 @@ var (
 				{ "name": "NextLocationID", "type": ["null", "long"] },
 				{ "name": "Recorded", "type": { "type": "long", "logicalType": "timestamp-millis" } },
 				{ "name": "Kind", "type": { "name": "Kind", "type": "enum", "symbols": [
-					"arrival_scan", "departure_scan", "delivered"
-				] } }
+					"arrival_scan", "departure_scan", "delivered",
+					"exception_delay", "misrouted", "damaged",
+					"delivery_attempt_failed", "returned_to_sender", "lost"
+				] } },
+				{ "name": "Mode", "type": ["null", { "name": "Mode", "type": "enum", "symbols": [
+					"land", "rail", "air", "sea"
+				] }], "default": null }
+			]
+		}
+	`)
+
+	routeSchema = avro.MustParse(`
+		{
+			"type": "record",
+			"name": "RouteHop",
+			"fields": [
+				{ "name": "PackageID", "type": { "type": "string", "logicalType": "uuid" } },
+				{ "name": "Hop", "type": "int" },
+				{ "name": "LocationID", "type": "long" },
+				{ "name": "PlannedArrival", "type": { "type": "long", "logicalType": "timestamp-millis" } },
+				{ "name": "PlannedDeparture", "type": ["null", { "type": "long", "logicalType": "timestamp-millis" }], "default": null }
+			]
+		}
+	`)
+
+	shipmentSchema = avro.MustParse(`
+		{
+			"type": "record",
+			"name": "Shipment",
+			"fields": [
+				{ "name": "ShipmentID", "type": { "type": "string", "logicalType": "uuid" } },
+				{ "name": "VehicleID", "type": "string" },
+				{ "name": "Mode", "type": { "name": "Mode", "type": "enum", "symbols": [
+					"land", "rail", "air", "sea"
+				] } },
+				{ "name": "OriginLocationID", "type": "long" },
+				{ "name": "DestinationLocationID", "type": "long" },
+				{ "name": "Departure", "type": { "type": "long", "logicalType": "timestamp-millis" } },
+				{ "name": "Arrival", "type": { "type": "long", "logicalType": "timestamp-millis" } },
+				{ "name": "PackageIDs", "type": { "type": "array", "items": { "type": "string", "logicalType": "uuid" } } }
+			]
+		}
+	`)
+
+	handoffSchema = avro.MustParse(`
+		{
+			"type": "record",
+			"name": "Handoff",
+			"fields": [
+				{ "name": "Region", "type": "string" },
+				{ "name": "PackageID", "type": { "type": "string", "logicalType": "uuid" } },
+				{ "name": "ParentPackageID", "type": { "type": "string", "logicalType": "uuid" } },
+				{ "name": "Method", "type": { "name": "Method", "type": "enum", "symbols": [
+					"standard", "express"
+				] } },
+				{ "name": "OriginLocationID", "type": "long" },
+				{ "name": "DestinationLocationID", "type": "long" },
+				{ "name": "OriginalDestinationLocationID", "type": "long" },
+				{ "name": "Returning", "type": "boolean" },
+				{ "name": "State", "type": "string" },
+				{ "name": "Seq", "type": "int" },
+				{ "name": "LastLocationID", "type": "long" },
+				{ "name": "NextLocationID", "type": "long" },
+				{ "name": "Mode", "type": "string" },
+				{ "name": "Misrouted", "type": "boolean" },
+				{ "name": "DeliveryAttempts", "type": "int" },
+				{ "name": "LastTransitionTime", "type": { "type": "long", "logicalType": "timestamp-micros" } },
+				{ "name": "NextTransitionTime", "type": { "type": "long", "logicalType": "timestamp-micros" } },
+				{ "name": "Route", "type": { "type": "array", "items": {
+					"type": "record",
+					"name": "PlannedHop",
+					"fields": [
+						{ "name": "LocationID", "type": "long" },
+						{ "name": "PlannedArrival", "type": { "type": "long", "logicalType": "timestamp-micros" } },
+						{ "name": "PlannedDeparture", "type": { "type": "long", "logicalType": "timestamp-micros" } },
+						{ "name": "Mode", "type": "string" }
+					]
+				} } },
+				{ "name": "Hop", "type": "int" },
+				{ "name": "OffRoute", "type": "boolean" },
+				{ "name": "Received", "type": { "type": "long", "logicalType": "timestamp-micros" } },
+				{ "name": "PlannedTransit", "type": "long" },
+				{ "name": "DeliveryEstimate", "type": { "type": "long", "logicalType": "timestamp-micros" } }
+			]
+		}
+	`)
+
+	checkpointSchema = avro.MustParse(`
+		{
+			"type": "record",
+			"name": "CheckpointMarker",
+			"fields": [
+				{ "name": "SimulatorID", "type": "string" },
+				{ "name": "Seq", "type": "long" },
+				{ "name": "Now", "type": { "type": "long", "logicalType": "timestamp-millis" } }
 			]
 		}
 	`)
 )
 
+// CheckpointTopic contains a marker for every transaction committed with a checkpoint
+const CheckpointTopic = "checkpoints"
+
+// topicSchemas contains the schema of each topic's records
+var topicSchemas = map[string]avro.Schema{
+	"packages":       packageSchema,
+	"transitions":    transitionSchema,
+	"shipments":      shipmentSchema,
+	"package_routes": routeSchema,
+	HandoffTopic:     handoffSchema,
+	CheckpointTopic:  checkpointSchema,
+}
+
+// RegisterSchemas registers the schema of every topic with the schema registry
+// at url under the subject <topic>-value and returns the id of each topic's schema
+func RegisterSchemas(url string) (map[string]int, error) {
+	// register the topics in order so a new registry always assigns the same ids
+	topics := make([]string, 0, len(topicSchemas))
+	for topic := range topicSchemas {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	client := registry.NewClient(url)
+	ids := make(map[string]int, len(topicSchemas))
+	for _, topic := range topics {
+		id, err := client.Register(topic+"-value", topicSchemas[topic].String())
+		if err != nil {
+			return nil, err
+		}
+		ids[topic] = id
+	}
+	return ids, nil
+}
+
+// SchemaIDsFromConfig returns the id of each topic's schema for tools reading
+// the topics, or an empty map when records aren't framed with a schema id
+// simulators running the embedded registry persisted it's schemas to a file so
+// they're served again on a free port, and registering the schemas again
+// returns the ids the simulators used
+func SchemaIDsFromConfig(config *TopicsConfig) (map[string]int, error) {
+	if config.Registry.URL == "" && config.Registry.Serve != "" {
+		r, err := registry.Open(config.Registry.File)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open schema registry")
+		}
+		config.Registry.URL, err = registry.Serve("localhost:0", r)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to start schema registry")
+		}
+	}
+	if config.Registry.URL == "" {
+		return make(map[string]int), nil
+	}
+	return RegisterSchemas(config.Registry.URL)
+}
+
+// bufferWriter appends everything written to it to the current record buffer
+// the avro encoder reuses it's own buffer so the record has to be copied out
+type bufferWriter struct {
+	b *RecordBuffer
+}
+
+func (w *bufferWriter) Write(d []byte) (int, error) {
+	return w.b.Write(d)
+}
+
+// topicEncoder encodes each record into it's own buffer which is handed to
+// the topic's writer
+type topicEncoder struct {
+	w       RecordWriter
+	out     *bufferWriter
+	encoder *avro.Encoder
+
+	// id is the schema id records are prefixed with, 0 leaves records unframed
+	id int
+}
+
+func newTopicEncoder(w RecordWriter, schema avro.Schema, id int) *topicEncoder {
+	out := &bufferWriter{}
+	return &topicEncoder{
+		w:       w,
+		out:     out,
+		encoder: avro.NewEncoderForSchema(schema, out),
+		id:      id,
+	}
+}
+
+func (e *topicEncoder) Encode(key RecordKey, v interface{}) error {
+	b, err := e.encode(v)
+	if err != nil {
+		return err
+	}
+	return e.w.WriteRecord(key, b)
+}
+
+// encode returns a buffer containing the encoded record
+func (e *topicEncoder) encode(v interface{}) (*RecordBuffer, error) {
+	b := NewRecordBuffer()
+	if e.id != 0 {
+		b.B = registry.AppendHeader(b.B, e.id)
+	}
+
+	e.out.b = b
+	err := e.encoder.Encode(v)
+	e.out.b = nil
+	if err != nil {
+		b.Release()
+		return nil, err
+	}
+	return b, nil
+}
+
+// decodeRecord decodes a record written to topic
+// framed records must have been written with the schema registered for topic
+func decodeRecord(schemaIDs map[string]int, topic string, d []byte, v interface{}) error {
+	if id, ok := schemaIDs[topic]; ok {
+		recordID, record, err := registry.Unframe(d)
+		if err != nil {
+			return err
+		}
+		if recordID != id {
+			return errors.Errorf("record has schema id %d; expected %d", recordID, id)
+		}
+		d = record
+	}
+	return avro.Unmarshal(topicSchemas[topic], d, v)
+}
+
 type Topics struct {
-	producer Producer
+	producer  Producer
+	keys      *RecordKeys
+	schemaIDs map[string]int
 
-	packageEncoder    *avro.Encoder
-	transitionEncoder *avro.Encoder
+	packageEncoder    *topicEncoder
+	transitionEncoder *topicEncoder
+	shipmentEncoder   *topicEncoder
+	routeEncoder      *topicEncoder
+	handoffEncoder    *topicEncoder
+	checkpointEncoder *topicEncoder
 }
 
-func NewTopics(producer Producer) *Topics {
+// NewTopics writes records to producer
+// records are framed with their schema id when schemaIDs isn't empty
+func NewTopics(producer Producer, schemaIDs map[string]int, keys *RecordKeys) *Topics {
+	encoder := func(topic string) *topicEncoder {
+		return newTopicEncoder(producer.TopicWriter(topic), topicSchemas[topic], schemaIDs[topic])
+	}
+
 	return &Topics{
-		producer: producer,
+		producer:  producer,
+		keys:      keys,
+		schemaIDs: schemaIDs,
 
-		packageEncoder:    avro.NewEncoderForSchema(packageSchema, producer.TopicWriter("packages")),
-		transitionEncoder: avro.NewEncoderForSchema(transitionSchema, producer.TopicWriter("transitions")),
+		packageEncoder:    encoder("packages"),
+		transitionEncoder: encoder("transitions"),
+		shipmentEncoder:   encoder("shipments"),
+		routeEncoder:      encoder("package_routes"),
+		handoffEncoder:    encoder(HandoffTopic),
+		checkpointEncoder: encoder(CheckpointTopic),
 	}
 }
 
+// Flush blocks until every record written so far has been persisted
+func (r *Topics) Flush() error {
+	return r.producer.Flush()
+}
+
+// Transactional returns true if records are only produced when they're
+// committed with a checkpoint
+func (r *Topics) Transactional() bool {
+	tp, ok := r.producer.(TransactionalProducer)
+	return ok && tp.Transactional()
+}
+
+// Commit atomically produces every record written since the last commit
+// along with the marker
+func (r *Topics) Commit(m *CheckpointMarker) error {
+	tp, ok := r.producer.(TransactionalProducer)
+	if !ok {
+		return errors.New("producer isn't transactional")
+	}
+	b, err := r.checkpointEncoder.encode(m)
+	if err != nil {
+		return err
+	}
+	return tp.Commit(b)
+}
+
+// LastCommit returns the marker of the producer's last commit or nil if it
+// hasn't committed anything yet
+func (r *Topics) LastCommit() (*CheckpointMarker, error) {
+	tp, ok := r.producer.(TransactionalProducer)
+	if !ok {
+		return nil, errors.New("producer isn't transactional")
+	}
+	d, err := tp.LastCommit()
+	if err != nil || d == nil {
+		return nil, err
+	}
+	var m CheckpointMarker
+	err = decodeRecord(r.schemaIDs, CheckpointTopic, d, &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
 func (r *Topics) WritePackage(p *Package) error {
-	return r.packageEncoder.Encode(p)
+	return r.packageEncoder.Encode(r.keys.Key(p.PackageID, p.DestinationLocationID), p)
 }
 
 func (r *Topics) WriteTransition(now time.Time, transition enum.TransitionKind, t *Tracker) error {
-	return r.transitionEncoder.Encode(&Transition{
+	var mode *enum.TransportMode
+	if transition == enum.DepartureScan {
+		mode = &t.Mode
+	}
+
+	return r.transitionEncoder.Encode(r.keys.Key(t.PackageID, t.OriginalDestinationLocationID), &Transition{
 		PackageID:      t.PackageID,
 		Seq:            t.Seq,
 		LocationID:     t.LastLocationID,
 		NextLocationID: t.NextLocationID,
 		Recorded:       now,
 		Kind:           transition,
+		Mode:           mode,
 	})
 }
+
+func (r *Topics) WriteShipment(s *Shipment) error {
+	return r.shipmentEncoder.Encode(r.keys.Key(s.ShipmentID, s.DestinationLocationID), s)
+}
+
+func (r *Topics) WriteRouteHop(t *Tracker, h *RouteHop) error {
+	return r.routeEncoder.Encode(r.keys.Key(t.PackageID, t.OriginalDestinationLocationID), h)
+}
+
+func (r *Topics) WriteHandoff(h *Handoff) error {
+	return r.handoffEncoder.Encode(r.keys.Key(h.PackageID, h.OriginalDestinationLocationID), h)
+}
@@ -0,0 +1,161 @@
+package simulator
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"simulator/enum"
+	"simulator/registry"
+)
+
+func testSchemaIDs(t *testing.T) map[string]int {
+	t.Helper()
+	r, err := registry.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(registry.NewServer(r))
+	t.Cleanup(srv.Close)
+
+	schemaIDs, err := RegisterSchemas(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schemaIDs
+}
+
+func TestDecodeRecord(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 6, 7, 8e6, time.UTC)
+	pkg := &Package{
+		PackageID:             uuid.NewV4(),
+		SimulatorID:           "test",
+		Received:              now,
+		OriginLocationID:      1,
+		DestinationLocationID: 2,
+		DeliveryEstimate:      now.Add(48 * time.Hour),
+		Method:                enum.Express,
+	}
+	tracker := &Tracker{
+		PackageID:                     pkg.PackageID,
+		DestinationLocationID:         pkg.DestinationLocationID,
+		OriginalDestinationLocationID: pkg.DestinationLocationID,
+		Seq:                           3,
+		LastLocationID:                1,
+		NextLocationID:                2,
+		Mode:                          enum.Air,
+	}
+
+	for name, schemaIDs := range map[string]map[string]int{
+		"raw":    nil,
+		"framed": testSchemaIDs(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			producer := NewMemoryProducer()
+			topics := NewTopics(producer, schemaIDs, NewRecordKeys(PackagePartitioner, "test", &World{}))
+			if err := topics.WritePackage(pkg); err != nil {
+				t.Fatal(err)
+			}
+			if err := topics.WriteTransition(now, enum.DepartureScan, tracker); err != nil {
+				t.Fatal(err)
+			}
+
+			packages := producer.Records("packages")
+			transitions := producer.Records("transitions")
+			if len(packages) != 1 || len(transitions) != 1 {
+				t.Fatalf("expected 1 package and 1 transition, got %d and %d", len(packages), len(transitions))
+			}
+
+			if schemaIDs != nil {
+				id, _, err := registry.Unframe(packages[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if id != schemaIDs["packages"] {
+					t.Errorf("expected the package to be framed with schema id %d, got %d", schemaIDs["packages"], id)
+				}
+
+				var transition Transition
+				err = decodeRecord(schemaIDs, "transitions", packages[0], &transition)
+				if err == nil {
+					t.Error("expected an error decoding a package as a transition")
+				}
+			}
+
+			var decodedPackage Package
+			err := decodeRecord(schemaIDs, "packages", packages[0], &decodedPackage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decodedPackage.PackageID != pkg.PackageID ||
+				decodedPackage.SimulatorID != pkg.SimulatorID ||
+				!decodedPackage.Received.Equal(pkg.Received) ||
+				decodedPackage.OriginLocationID != pkg.OriginLocationID ||
+				decodedPackage.DestinationLocationID != pkg.DestinationLocationID ||
+				!decodedPackage.DeliveryEstimate.Equal(pkg.DeliveryEstimate) ||
+				decodedPackage.Method != pkg.Method ||
+				decodedPackage.ParentPackageID != nil {
+				t.Errorf("expected package %+v, got %+v", pkg, decodedPackage)
+			}
+
+			// NextLocationID is nullable so it can't be decoded into Transition
+			var transition struct {
+				PackageID      uuid.UUID
+				Seq            int
+				LocationID     int64
+				NextLocationID *int64
+				Recorded       time.Time
+				Kind           enum.TransitionKind
+				Mode           *enum.TransportMode
+			}
+			err = decodeRecord(schemaIDs, "transitions", transitions[0], &transition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if transition.PackageID != tracker.PackageID ||
+				transition.Seq != tracker.Seq ||
+				transition.LocationID != tracker.LastLocationID ||
+				transition.NextLocationID == nil || *transition.NextLocationID != tracker.NextLocationID ||
+				!transition.Recorded.Equal(now) ||
+				transition.Kind != enum.DepartureScan ||
+				transition.Mode == nil || *transition.Mode != enum.Air {
+				t.Errorf("unexpected transition %+v", transition)
+			}
+		})
+	}
+}
+
+func TestSchemaIDsFromConfig(t *testing.T) {
+	schemaIDs, err := SchemaIDsFromConfig(&TopicsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schemaIDs) != 0 {
+		t.Errorf("expected no schema ids without a registry, got %v", schemaIDs)
+	}
+
+	// the embedded registry is served again from it's file
+	config := &TopicsConfig{Registry: RegistryConfig{
+		Serve: "localhost:0",
+		File:  filepath.Join(t.TempDir(), "registry.json"),
+	}}
+	schemaIDs, err = SchemaIDsFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Registry.URL == "" {
+		t.Error("expected the registry url to be set")
+	}
+	want := testSchemaIDs(t)
+	if len(schemaIDs) != len(want) {
+		t.Fatalf("expected schema ids %v, got %v", want, schemaIDs)
+	}
+	for topic, id := range want {
+		if schemaIDs[topic] != id {
+			t.Errorf("%s: expected schema id %d, got %d", topic, id, schemaIDs[topic])
+		}
+	}
+}
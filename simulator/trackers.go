@@ -5,15 +5,22 @@ import (
 	"simulator/enum"
 	"time"
 
-	"github.com/paulmach/orb/planar"
 	uuid "github.com/satori/go.uuid"
 )
 
 type Tracker struct {
 	// The following fields should never change
-	PackageID             uuid.UUID
-	Method                enum.DeliveryMethod
-	DestinationLocationID int64
+	PackageID        uuid.UUID
+	ParentPackageID  uuid.UUID
+	Method           enum.DeliveryMethod
+	OriginLocationID int64
+
+	// DestinationLocationID is swapped with OriginLocationID when a package is returned to sender
+	// OriginalDestinationLocationID keeps the destination the package was sent
+	// to, records are keyed on it so they stay in the same partition
+	DestinationLocationID         int64
+	OriginalDestinationLocationID int64
+	Returning                     bool
 
 	// The following fields may be updated on each transition
 	Delivered      bool
@@ -21,52 +28,91 @@ type Tracker struct {
 	Seq            int
 	LastLocationID int64
 
+	// Queued is true while the package waits for it's reserved processing slot
+	// QueueMark is the number of preemptions of the location's queue when the
+	// slot was reserved
+	Queued    bool
+	QueueMark int
+
+	// Misrouted is true while the package travels to the wrong location
+	Misrouted        bool
+	DeliveryAttempts int
+
+	// ShipmentID is set while the package waits for it's shipment to depart
+	// LegDuration is the time the shipment takes to reach NextLocationID
+	ShipmentID  uuid.UUID
+	LegDuration time.Duration
+
+	LastTransitionTime time.Time
 	NextTransitionTime time.Time
 	NextLocationID     int64
+
+	// Mode is the mode of the leg towards NextLocationID
+	Mode enum.TransportMode
+
+	// Route is the planned route; Hop is the last planned hop the package reached
+	// OffRoute is set once the package deviates from it's planned route
+	Route    []PlannedHop
+	Hop      int
+	OffRoute bool
+
+	// Received, PlannedTransit and DeliveryEstimate are used to calibrate
+	// delivery estimates once the package is delivered
+	Received         time.Time
+	PlannedTransit   time.Duration
+	DeliveryEstimate time.Time
+
+	// handoff is set on handed off packages until a worker accepts them
+	handoff *handoffOffset
 }
 
 type Trackers []*Tracker
 
 var _ heap.Interface = &Trackers{}
 
-func NewTrackersFromActivePackages(c *Config, l *LocationIndex, packages []DBActivePackage) (Trackers, error) {
+// NewTrackersFromActivePackages restores trackers from the database
+// packages in transit arrive after the planned duration of their leg
+func NewTrackersFromActivePackages(world *World, packages []DBActivePackage) (Trackers, error) {
 	out := make(Trackers, 0, len(packages))
 
 	for _, pkg := range packages {
-		var nextTransitionTime time.Time
+		var (
+			nextTransitionTime time.Time
+			mode               enum.TransportMode
+		)
 
 		if pkg.StateKind == enum.InTransit {
-			segmentStart, err := l.Lookup(pkg.TransitionLocationID)
+			segmentStart, err := world.Locations.Lookup(pkg.TransitionLocationID)
 			if err != nil {
 				return nil, err
 			}
-			segmentEnd, err := l.Lookup(pkg.TransitionNextLocationID)
+			segmentEnd, err := world.Locations.Lookup(pkg.TransitionNextLocationID)
 			if err != nil {
 				return nil, err
 			}
 
-			segmentDistance := planar.Distance(segmentStart.Position, segmentEnd.Position) / 1000
-			speed := c.AvgLandSpeedKMPH
-			if segmentDistance > c.MinAirFreightDistanceKM {
-				speed = c.AvgAirSpeedKMPH
-			}
-
-			duration := time.Hour * time.Duration(segmentDistance/speed)
+			m, duration := transit(world.Modes, segmentStart, segmentEnd, pkg.Method)
+			mode = m.Mode
 			nextTransitionTime = pkg.TransitionRecorded.Add(duration)
 		}
 
 		out = append(out, &Tracker{
-			PackageID:             pkg.PackageID,
-			Method:                pkg.Method,
-			DestinationLocationID: pkg.DestinationLocationID,
+			PackageID:                     pkg.PackageID,
+			Method:                        pkg.Method,
+			OriginLocationID:              pkg.OriginLocationID,
+			DestinationLocationID:         pkg.DestinationLocationID,
+			OriginalDestinationLocationID: pkg.OriginalDestinationLocationID,
+			Returning:                     pkg.Returning,
 
 			Delivered:      false,
 			State:          pkg.StateKind,
 			Seq:            pkg.TransitionSeq,
 			LastLocationID: pkg.TransitionLocationID,
 
+			LastTransitionTime: pkg.TransitionRecorded,
 			NextTransitionTime: nextTransitionTime,
 			NextLocationID:     pkg.TransitionNextLocationID,
+			Mode:               mode,
 		})
 	}
 
@@ -75,6 +121,33 @@ func NewTrackersFromActivePackages(c *Config, l *LocationIndex, packages []DBAct
 	return out, nil
 }
 
+// ActivePackages converts the trackers into the form returned by Database.ActivePackages
+func (t Trackers) ActivePackages() []DBActivePackage {
+	out := make([]DBActivePackage, 0, len(t))
+	for _, tracker := range t {
+		// pending returns haven't been received so they can't be restored
+		if tracker.State == enum.Pending {
+			continue
+		}
+
+		out = append(out, DBActivePackage{
+			PackageID:                     tracker.PackageID,
+			Method:                        tracker.Method,
+			OriginLocationID:              tracker.OriginLocationID,
+			DestinationLocationID:         tracker.DestinationLocationID,
+			OriginalDestinationLocationID: tracker.OriginalDestinationLocationID,
+			Returning:                     tracker.Returning,
+
+			StateKind:                tracker.State,
+			TransitionSeq:            tracker.Seq,
+			TransitionLocationID:     tracker.LastLocationID,
+			TransitionNextLocationID: tracker.NextLocationID,
+			TransitionRecorded:       tracker.LastTransitionTime,
+		})
+	}
+	return out
+}
+
 func (t Trackers) Len() int { return len(t) }
 func (t Trackers) Less(i, j int) bool {
 	return t[i].NextTransitionTime.Before(t[j].NextTransitionTime)
@@ -0,0 +1,112 @@
+package simulator
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"simulator/enum"
+)
+
+func TestNewTrackersFromActivePackages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfigs([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	world := testWorld(t, config)
+
+	recorded := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	packages := []DBActivePackage{
+		{
+			// a short leg by land
+			PackageID:                     uuid.NewV4(),
+			Method:                        enum.Standard,
+			OriginLocationID:              1,
+			DestinationLocationID:         91,
+			OriginalDestinationLocationID: 91,
+			StateKind:                     enum.InTransit,
+			TransitionSeq:                 2,
+			TransitionLocationID:          1,
+			TransitionNextLocationID:      2,
+			TransitionRecorded:            recorded,
+		},
+		{
+			// a long leg by air
+			PackageID:                     uuid.NewV4(),
+			Method:                        enum.Express,
+			OriginLocationID:              1,
+			DestinationLocationID:         91,
+			OriginalDestinationLocationID: 91,
+			StateKind:                     enum.InTransit,
+			TransitionSeq:                 2,
+			TransitionLocationID:          1,
+			TransitionNextLocationID:      91,
+			TransitionRecorded:            recorded,
+		},
+		{
+			PackageID:                     uuid.NewV4(),
+			Method:                        enum.Standard,
+			OriginLocationID:              91,
+			DestinationLocationID:         91,
+			OriginalDestinationLocationID: 1,
+			Returning:                     true,
+			StateKind:                     enum.AtRest,
+			TransitionSeq:                 7,
+			TransitionLocationID:          50,
+			TransitionNextLocationID:      50,
+			TransitionRecorded:            recorded,
+		},
+	}
+
+	trackers, err := NewTrackersFromActivePackages(world, packages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := &State{Modes: world.Modes}
+	byID := make(map[uuid.UUID]*Tracker)
+	for _, tracker := range trackers {
+		byID[tracker.PackageID] = tracker
+	}
+	for i, pkg := range packages {
+		tracker := byID[pkg.PackageID]
+		if pkg.StateKind != enum.InTransit {
+			if !tracker.NextTransitionTime.IsZero() {
+				t.Errorf("package %d: expected a package at rest to be due now, got %s", i, tracker.NextTransitionTime)
+			}
+			continue
+		}
+
+		from, _ := world.Locations.Lookup(pkg.TransitionLocationID)
+		to, _ := world.Locations.Lookup(pkg.TransitionNextLocationID)
+		mode, duration := state.Transit(from, to, pkg.Method)
+		if tracker.Mode != mode.Mode || !tracker.NextTransitionTime.Equal(recorded.Add(duration)) {
+			t.Errorf("package %d: expected to arrive by %s at %s, got %s at %s",
+				i, mode.Mode, recorded.Add(duration), tracker.Mode, tracker.NextTransitionTime)
+		}
+	}
+	if byID[packages[0].PackageID].Mode != enum.Land || byID[packages[1].PackageID].Mode != enum.Air {
+		t.Errorf("expected the short leg by land and the long leg by air, got %s and %s",
+			byID[packages[0].PackageID].Mode, byID[packages[1].PackageID].Mode)
+	}
+
+	// the trackers convert back into the packages they were restored from
+	restored := trackers.ActivePackages()
+	for _, pkg := range restored {
+		for _, want := range packages {
+			if pkg.PackageID == want.PackageID && pkg != want {
+				t.Errorf("expected %+v, got %+v", want, pkg)
+			}
+		}
+	}
+	if len(restored) != len(packages) {
+		t.Errorf("expected %d packages, got %d", len(packages), len(restored))
+	}
+}
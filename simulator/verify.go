@@ -0,0 +1,126 @@
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// OrderVerifier checks the transitions of each package are consumed in the
+// order they were written
+// a package whose partition key changed was moved to another partition by
+// the simulator that wrote it, which is always a failure; other splits are
+// expected when packages are handed off between simulators which write to
+// separate partitions
+type OrderVerifier struct {
+	schemaIDs   map[string]int
+	partitioner string
+	packages    map[uuid.UUID]*packageOrder
+
+	Records             int
+	Undecodable         int
+	KeyMismatch         int
+	PartitionKeyChanged int
+	OutOfOrder          int
+	Duplicates          int
+	SplitPackage        int
+}
+
+type packageOrder struct {
+	partition    string
+	partitionKey []byte
+	split        bool
+	lastSeq      int
+}
+
+// NewOrderVerifier checks records written with the given partitioner
+// the simulator partitioner changes the partition key of packages handed off
+// to another simulator so changes aren't checked
+func NewOrderVerifier(schemaIDs map[string]int, partitioner string) *OrderVerifier {
+	return &OrderVerifier{
+		schemaIDs:   schemaIDs,
+		partitioner: partitioner,
+		packages:    make(map[uuid.UUID]*packageOrder),
+	}
+}
+
+// Add checks a record consumed from the transitions topic
+// records must be added in the order they were read from each partition
+func (v *OrderVerifier) Add(r ConsumedRecord) {
+	v.Records++
+
+	// only decode the fields needed to check the order; the avro decoder skips
+	// the rest
+	var t struct {
+		PackageID uuid.UUID
+		Seq       int
+	}
+	err := decodeRecord(v.schemaIDs, "transitions", r.Value, &t)
+	if err != nil {
+		v.Undecodable++
+		return
+	}
+	if r.Key != nil && !bytes.Equal(r.Key, []byte(t.PackageID.String())) {
+		v.KeyMismatch++
+	}
+
+	p, ok := v.packages[t.PackageID]
+	if !ok {
+		v.packages[t.PackageID] = &packageOrder{partition: r.Partition, partitionKey: r.PartitionKey, lastSeq: t.Seq}
+		return
+	}
+	if p.split {
+		return
+	}
+
+	if v.partitioner != SimulatorPartitioner && p.partitionKey != nil && r.PartitionKey != nil &&
+		!bytes.Equal(p.partitionKey, r.PartitionKey) {
+		p.split = true
+		v.PartitionKeyChanged++
+		return
+	}
+
+	// records in different partitions aren't ordered relative to each other
+	// so only the first split is counted and the package isn't checked further
+	if p.partition != r.Partition {
+		p.split = true
+		v.SplitPackage++
+		return
+	}
+
+	switch {
+	case t.Seq == p.lastSeq:
+		v.Duplicates++
+	case t.Seq < p.lastSeq:
+		v.OutOfOrder++
+	default:
+		p.lastSeq = t.Seq
+	}
+}
+
+// Packages returns the number of distinct packages seen
+func (v *OrderVerifier) Packages() int {
+	return len(v.packages)
+}
+
+// Failed returns true if any package's records were out of order
+// set allowSplit when records of a package are expected in several partitions
+func (v *OrderVerifier) Failed(allowSplit bool) bool {
+	if v.Undecodable > 0 || v.KeyMismatch > 0 || v.PartitionKeyChanged > 0 || v.OutOfOrder > 0 || v.Duplicates > 0 {
+		return true
+	}
+	return !allowSplit && v.SplitPackage > 0
+}
+
+func (v *OrderVerifier) Report(w io.Writer) {
+	fmt.Fprintf(w, "records:       %d\n", v.Records)
+	fmt.Fprintf(w, "packages:      %d\n", v.Packages())
+	fmt.Fprintf(w, "undecodable:   %d\n", v.Undecodable)
+	fmt.Fprintf(w, "key mismatch:  %d\n", v.KeyMismatch)
+	fmt.Fprintf(w, "key changed:   %d\n", v.PartitionKeyChanged)
+	fmt.Fprintf(w, "out of order:  %d\n", v.OutOfOrder)
+	fmt.Fprintf(w, "duplicates:    %d\n", v.Duplicates)
+	fmt.Fprintf(w, "split:         %d\n", v.SplitPackage)
+}
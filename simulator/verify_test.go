@@ -0,0 +1,64 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"simulator/enum"
+)
+
+func TestOrderVerifierPartitionKey(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	tracker := &Tracker{
+		PackageID:                     uuid.NewV4(),
+		DestinationLocationID:         2,
+		OriginalDestinationLocationID: 2,
+		LastLocationID:                1,
+		NextLocationID:                2,
+		Mode:                          enum.Land,
+	}
+
+	producer := NewMemoryProducer()
+	topics := NewTopics(producer, nil, NewRecordKeys(PackagePartitioner, "test", &World{}))
+	for seq := 1; seq <= 2; seq++ {
+		tracker.Seq = seq
+		if err := topics.WriteTransition(now, enum.ArrivalScan, tracker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	transitions := producer.Records("transitions")
+	key := []byte(tracker.PackageID.String())
+
+	for _, c := range []struct {
+		name        string
+		partitioner string
+		keys        []string
+		partitions  []string
+		changed     int
+		split       int
+	}{
+		{"same key", RegionPartitioner, []string{"a", "a"}, []string{"0", "0"}, 0, 0},
+		{"changed key", RegionPartitioner, []string{"a", "b"}, []string{"0", "1"}, 1, 0},
+		{"simulator handoff", SimulatorPartitioner, []string{"a", "b"}, []string{"0", "1"}, 0, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			v := NewOrderVerifier(nil, c.partitioner)
+			for i, value := range transitions {
+				v.Add(ConsumedRecord{
+					Partition:    c.partitions[i],
+					Key:          key,
+					PartitionKey: []byte(c.keys[i]),
+					Value:        value,
+				})
+			}
+			if v.PartitionKeyChanged != c.changed || v.SplitPackage != c.split {
+				t.Errorf("expected %d changed and %d split, got %d and %d", c.changed, c.split, v.PartitionKeyChanged, v.SplitPackage)
+			}
+			if v.Failed(true) != (c.changed > 0) {
+				t.Errorf("expected Failed(true) to be %v", c.changed > 0)
+			}
+		})
+	}
+}